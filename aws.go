@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// awsSSOProfile AWS SSO profile whose role credentials are passed to restic, refreshed before they expire
+type awsSSOProfile struct {
+	name       string
+	startURL   string
+	region     string
+	accountID  string
+	roleName   string
+	cacheKey   string
+	lock       *sync.Mutex
+	creds      []string
+	expiration time.Time
+}
+
+// awsSSO SSO profile used by s3 repositories without static keys. nil if not used
+var awsSSO *awsSSOProfile
+
+// awsCredentialsMargin how long before expiry SSO role credentials are fetched again, so they outlast long restic commands
+var awsCredentialsMargin = 15 * time.Minute
+
+// awsCredentialSource return the AWS default chain source restic will use when no static keys are configured, or empty if none is available
+func awsCredentialSource(profile string) (string, error) {
+	if os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "" {
+		return "web identity (IRSA)", nil
+	}
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		return "container (ECS)", nil
+	}
+	if profile != "" {
+		sso, err := loadAWSSSOProfile(profile)
+		if err != nil {
+			return "", err
+		}
+		if sso != nil {
+			awsSSO = sso
+			return fmt.Sprintf("SSO profile %s", profile), nil
+		}
+	}
+	credentialsFile := firstNonEmpty(os.Getenv("AWS_SHARED_CREDENTIALS_FILE"), filepath.Join(os.Getenv("HOME"), ".aws", "credentials"))
+	_, err := os.Stat(credentialsFile)
+	if err == nil {
+		return fmt.Sprintf("shared credentials file %s", credentialsFile), nil
+	}
+	if awsInstanceProfileAvailable() {
+		return "instance profile", nil
+	}
+	return "", nil
+}
+
+// awsInstanceProfileAvailable whether the EC2 instance metadata service answers (IMDSv2)
+func awsInstanceProfileAvailable() bool {
+	client := &http.Client{Timeout: 2 * time.Second}
+	req, err := http.NewRequest("PUT", "http://169.254.169.254/latest/api/token", nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == 200
+}
+
+// loadAWSSSOProfile read the SSO settings of a profile from the AWS config file. nil if the profile doesn't use SSO
+func loadAWSSSOProfile(profile string) (*awsSSOProfile, error) {
+	file := os.Getenv("AWS_CONFIG_FILE")
+	if file == "" {
+		file = filepath.Join(os.Getenv("HOME"), ".aws", "config")
+	}
+	sections, err := readINI(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read AWS config %s. err=%s", file, err)
+	}
+	section := "profile " + profile
+	if profile == "default" {
+		section = "default"
+	}
+	p, ok := sections[section]
+	if !ok {
+		return nil, fmt.Errorf("AWS profile %s not found in %s", profile, file)
+	}
+	if p["sso_account_id"] == "" || p["sso_role_name"] == "" {
+		return nil, nil
+	}
+
+	sso := &awsSSOProfile{
+		name:      profile,
+		startURL:  p["sso_start_url"],
+		region:    p["sso_region"],
+		accountID: p["sso_account_id"],
+		roleName:  p["sso_role_name"],
+		cacheKey:  p["sso_start_url"],
+		lock:      &sync.Mutex{},
+	}
+	//newer configs reference a [sso-session] section and cache the token by session name
+	session := p["sso_session"]
+	if session != "" {
+		s, ok := sections["sso-session "+session]
+		if !ok {
+			return nil, fmt.Errorf("AWS sso-session %s not found in %s", session, file)
+		}
+		sso.startURL = s["sso_start_url"]
+		sso.region = s["sso_region"]
+		sso.cacheKey = session
+	}
+	if sso.startURL == "" || sso.region == "" {
+		return nil, fmt.Errorf("sso_start_url and sso_region are required for AWS SSO profile %s", profile)
+	}
+	return sso, nil
+}
+
+// env return the role credentials of the SSO profile as restic environment variables, fetching new ones when they are about to expire
+func (s *awsSSOProfile) env() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.creds != nil && time.Until(s.expiration) > awsCredentialsMargin {
+		return s.creds, nil
+	}
+
+	sum := sha1.Sum([]byte(s.cacheKey))
+	cacheFile := filepath.Join(os.Getenv("HOME"), ".aws", "sso", "cache", hex.EncodeToString(sum[:])+".json")
+	data, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read AWS SSO token cache %s. Run 'aws sso login --profile %s'. err=%s", cacheFile, s.name, err)
+	}
+	token := struct {
+		AccessToken string `json:"accessToken"`
+		ExpiresAt   string `json:"expiresAt"`
+	}{}
+	err = json.Unmarshal(data, &token)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid AWS SSO token cache %s. err=%s", cacheFile, err)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, strings.Replace(token.ExpiresAt, "UTC", "Z", 1))
+	if err == nil && time.Now().After(expiresAt) {
+		return nil, fmt.Errorf("AWS SSO token of profile %s expired. Run 'aws sso login --profile %s'", s.name, s.name)
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://portal.sso.%s.amazonaws.com/federation/credentials?account_id=%s&role_name=%s", s.region, url.QueryEscape(s.accountID), url.QueryEscape(s.roleName)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-amz-sso_bearer_token", token.AccessToken)
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get AWS SSO role credentials. err=%s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Couldn't get AWS SSO role credentials. status=%d response=%s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	result := struct {
+		RoleCredentials struct {
+			AccessKeyID     string `json:"accessKeyId"`
+			SecretAccessKey string `json:"secretAccessKey"`
+			SessionToken    string `json:"sessionToken"`
+			Expiration      int64  `json:"expiration"`
+		} `json:"roleCredentials"`
+	}{}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid AWS SSO role credentials response. err=%s", err)
+	}
+	rc := result.RoleCredentials
+	s.expiration = time.Unix(0, rc.Expiration*int64(time.Millisecond))
+	s.creds = []string{
+		fmt.Sprintf("AWS_ACCESS_KEY_ID=%s", rc.AccessKeyID),
+		fmt.Sprintf("AWS_SECRET_ACCESS_KEY=%s", rc.SecretAccessKey),
+		fmt.Sprintf("AWS_SESSION_TOKEN=%s", rc.SessionToken),
+	}
+	logrus.Debugf("Got AWS SSO role credentials for profile %s. expiration=%s", s.name, s.expiration)
+	return s.creds, nil
+}
+
+// readINI parse an ini file into sections of key/values
+func readINI(file string) (map[string]map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sections := map[string]map[string]string{}
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			sections[current] = map[string]string{}
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 && current != "" {
+			sections[current][strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return sections, scanner.Err()
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// backendSchemes restic repository URL schemes of remote backends
+var backendSchemes = []string{"sftp:", "rest:", "s3:", "b2:", "azure:", "gs:", "swift:", "rclone:"}
+
+// repoBackend return the backend scheme of a repository URL ('local' for filesystem paths)
+func repoBackend(repo string) string {
+	for _, s := range backendSchemes {
+		if strings.HasPrefix(repo, s) {
+			return strings.TrimSuffix(s, ":")
+		}
+	}
+	return "local"
+}
+
+// isLocalRepo whether the repository is a directory on the local filesystem
+func isLocalRepo(repo string) bool {
+	return repoBackend(repo) == "local"
+}
+
+// setEnv set an environment variable inherited by restic processes if value is not empty
+func setEnv(name string, value string) {
+	if value == "" {
+		return
+	}
+	logrus.Debugf("Setting %s for restic", name)
+	os.Setenv(name, value)
+}
+
+// getEnv return an environment variable for restic processes of this repository, from the worker env or the repository secrets
+func (r *Repository) getEnv(name string) string {
+	value := os.Getenv(name)
+	if value != "" {
+		return value
+	}
+	secrets, err := r.secrets()
+	if err != nil {
+		logrus.Warnf("Couldn't read secrets of repository %s. err=%s", r.Name, err)
+		return ""
+	}
+	return secrets[name]
+}
+
+// configureS3 setup AWS credentials and endpoint for 's3:' repositories
+func configureS3(r *Repository, accessKeyID string, secretAccessKey string, region string, endpoint string, profile string) error {
+	if repoBackend(r.Repo) != "s3" {
+		return nil
+	}
+	setEnv("AWS_ACCESS_KEY_ID", accessKeyID)
+	setEnv("AWS_SECRET_ACCESS_KEY", secretAccessKey)
+	setEnv("AWS_DEFAULT_REGION", region)
+
+	if r.getEnv("AWS_ACCESS_KEY_ID") == "" || r.getEnv("AWS_SECRET_ACCESS_KEY") == "" {
+		//restic resolves (and refreshes during long commands) web identity, container and instance profile credentials by itself
+		source, err := awsCredentialSource(profile)
+		if err != nil {
+			return err
+		}
+		if source == "" {
+			return fmt.Errorf("AWS access key id and secret access key are required for s3 repositories when no IAM role (IRSA, ECS, instance profile), SSO profile or shared credentials file is available")
+		}
+		logrus.Infof("No static AWS keys configured. Using AWS credentials from %s", source)
+	}
+
+	if endpoint != "" {
+		endpoint = strings.TrimSuffix(endpoint, "/")
+		r.Repo = fmt.Sprintf("s3:%s/%s", endpoint, strings.TrimPrefix(r.Repo, "s3:"))
+	}
+	logrus.Infof("Using S3 repository %s", r.Repo)
+	return nil
+}
+
+// configureS3Compat setup addressing, region and TLS options for S3 compatible stores (ex.: MinIO) used by 's3:' repositories
+func configureS3Compat(r *Repository, pathStyle bool, region string, caCertFile string, insecureTLS bool) error {
+	if repoBackend(r.Repo) != "s3" {
+		return nil
+	}
+	if pathStyle {
+		r.options = append(r.options, "s3.bucket-lookup=path")
+	}
+	if region != "" {
+		r.options = append(r.options, fmt.Sprintf("s3.region=%s", region))
+	}
+	if caCertFile != "" {
+		_, err := os.Stat(caCertFile)
+		if err != nil {
+			return fmt.Errorf("S3 CA certificate file %s not accessible. err=%s", caCertFile, err)
+		}
+		r.flags = append(r.flags, "--cacert", caCertFile)
+	}
+	if insecureTLS {
+		logrus.Warnf("TLS certificate verification is disabled for S3 repository %s", r.Repo)
+		r.flags = append(r.flags, "--insecure-tls")
+	}
+	return nil
+}
+
+// configureB2 setup Backblaze credentials and options for 'b2:' repositories
+func configureB2(r *Repository, accountID string, accountKey string, connections int) error {
+	repo := r.Repo
+	if repoBackend(repo) != "b2" {
+		return nil
+	}
+	setEnv("B2_ACCOUNT_ID", accountID)
+	setEnv("B2_ACCOUNT_KEY", accountKey)
+
+	if r.getEnv("B2_ACCOUNT_ID") == "" || r.getEnv("B2_ACCOUNT_KEY") == "" {
+		return fmt.Errorf("B2 account id and account key are required for b2 repositories")
+	}
+
+	if connections > 0 {
+		r.options = append(r.options, fmt.Sprintf("b2.connections=%d", connections))
+	}
+	logrus.Infof("Using B2 repository %s", repo)
+	return nil
+}
+
+// configureAzure setup Azure Blob Storage credentials for 'azure:' repositories
+func configureAzure(r *Repository, accountName string, accountKey string, accountSAS string) error {
+	repo := r.Repo
+	if repoBackend(repo) != "azure" {
+		return nil
+	}
+	setEnv("AZURE_ACCOUNT_NAME", accountName)
+	setEnv("AZURE_ACCOUNT_KEY", accountKey)
+	setEnv("AZURE_ACCOUNT_SAS", accountSAS)
+
+	if r.getEnv("AZURE_ACCOUNT_NAME") == "" {
+		return fmt.Errorf("Azure account name is required for azure repositories")
+	}
+	if r.getEnv("AZURE_ACCOUNT_KEY") == "" && r.getEnv("AZURE_ACCOUNT_SAS") == "" {
+		return fmt.Errorf("Azure account key or SAS token is required for azure repositories")
+	}
+	logrus.Infof("Using Azure repository %s", repo)
+	return nil
+}
+
+// configureGCS setup Google Cloud Storage credentials for 'gs:' repositories
+func configureGCS(r *Repository, projectID string, credentialsFile string, credentialsJSON string) error {
+	repo := r.Repo
+	if repoBackend(repo) != "gs" {
+		return nil
+	}
+	setEnv("GOOGLE_PROJECT_ID", projectID)
+
+	if credentialsJSON != "" {
+		credentialsFile = filepath.Join(os.TempDir(), "gcs-credentials.json")
+		err := ioutil.WriteFile(credentialsFile, []byte(credentialsJSON), 0600)
+		if err != nil {
+			return fmt.Errorf("Couldn't write gcs credentials file. err=%s", err)
+		}
+	}
+	setEnv("GOOGLE_APPLICATION_CREDENTIALS", credentialsFile)
+
+	if r.getEnv("GOOGLE_PROJECT_ID") == "" {
+		return fmt.Errorf("Google project id is required for gs repositories")
+	}
+	if r.getEnv("GOOGLE_APPLICATION_CREDENTIALS") == "" {
+		logrus.Infof("No gcs credentials file configured. Using default credentials")
+	}
+	logrus.Infof("Using GCS repository %s", repo)
+	return nil
+}
+
+// configureSFTP setup the ssh command used by restic for 'sftp:' repositories
+func configureSFTP(r *Repository, keyFile string, port int, knownHostsFile string, acceptNewHostKeys bool) error {
+	repo := r.Repo
+	if repoBackend(repo) != "sftp" {
+		return nil
+	}
+	if keyFile == "" && port == 0 && knownHostsFile == "" {
+		logrus.Infof("Using SFTP repository %s with default ssh settings", repo)
+		return nil
+	}
+
+	userHost, urlPort, err := parseSFTPHost(repo)
+	if err != nil {
+		return err
+	}
+	if port == 0 && urlPort != "" {
+		p, err := strconv.Atoi(urlPort)
+		if err != nil {
+			return fmt.Errorf("Invalid port in sftp repository %s", repo)
+		}
+		port = p
+	}
+
+	command := fmt.Sprintf("ssh %s", userHost)
+	if keyFile != "" {
+		_, err := os.Stat(keyFile)
+		if err != nil {
+			return fmt.Errorf("SSH key file %s not accessible. err=%s", keyFile, err)
+		}
+		command = command + fmt.Sprintf(" -i %s -o IdentitiesOnly=yes", keyFile)
+	}
+	if port != 0 {
+		command = command + fmt.Sprintf(" -p %d", port)
+	}
+	if knownHostsFile != "" {
+		strict := "yes"
+		if acceptNewHostKeys {
+			strict = "accept-new"
+		}
+		command = command + fmt.Sprintf(" -o UserKnownHostsFile=%s -o StrictHostKeyChecking=%s", knownHostsFile, strict)
+	}
+	command = command + " -s sftp"
+
+	r.options = append(r.options, fmt.Sprintf("sftp.command=%s", command))
+	logrus.Infof("Using SFTP repository %s", repo)
+	return nil
+}
+
+// parseSFTPHost extract '[user@]host' and port from 'sftp:user@host:/path' or 'sftp://user@host:port//path' URLs
+func parseSFTPHost(repo string) (userHost string, port string, err error) {
+	if strings.HasPrefix(repo, "sftp://") {
+		u, err := url.Parse(repo)
+		if err != nil {
+			return "", "", fmt.Errorf("Invalid sftp repository %s. err=%s", repo, err)
+		}
+		userHost = u.Hostname()
+		if u.User != nil {
+			userHost = u.User.Username() + "@" + userHost
+		}
+		return userHost, u.Port(), nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(repo, "sftp:"), ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("Invalid sftp repository %s", repo)
+	}
+	return parts[0], "", nil
+}
+
+// configureRest add basic auth credentials to 'rest:' repository URLs. URLs with credentials are passed to restic in its env
+func configureRest(r *Repository, username string, password string) error {
+	if repoBackend(r.Repo) != "rest" {
+		return nil
+	}
+	if username == "" {
+		logrus.Infof("Using REST repository %s", r.Repo)
+		return nil
+	}
+
+	u, err := url.Parse(strings.TrimPrefix(r.Repo, "rest:"))
+	if err != nil {
+		return fmt.Errorf("Invalid rest repository %s. err=%s", r.Repo, err)
+	}
+	if u.User != nil {
+		logrus.Infof("Using REST repository %s with credentials from its URL", r.Name)
+		r.repoURL = r.Repo
+		return nil
+	}
+	logrus.Infof("Using REST repository %s with user %s", r.Repo, username)
+
+	u.User = url.UserPassword(username, password)
+	r.repoURL = "rest:" + u.String()
+	return nil
+}
+
+// configureTLS setup custom CA and client certificates used by restic on TLS connections
+func configureTLS(r *Repository, caCertFile string, clientCertFile string) error {
+	if caCertFile != "" {
+		_, err := os.Stat(caCertFile)
+		if err != nil {
+			return fmt.Errorf("CA certificate file %s not accessible. err=%s", caCertFile, err)
+		}
+		r.flags = append(r.flags, "--cacert", caCertFile)
+	}
+	if clientCertFile != "" {
+		_, err := os.Stat(clientCertFile)
+		if err != nil {
+			return fmt.Errorf("TLS client certificate file %s not accessible. err=%s", clientCertFile, err)
+		}
+		r.flags = append(r.flags, "--tls-client-cert", clientCertFile)
+	}
+	return nil
+}
+
+// configureRclone validate the rclone binary and remote used by 'rclone:' repositories
+func configureRclone(r *Repository, configFile string) error {
+	repo := r.Repo
+	if repoBackend(repo) != "rclone" {
+		return nil
+	}
+	setEnv("RCLONE_CONFIG", configFile)
+
+	version, err := ExecCmd("rclone", "version")
+	if err != nil {
+		return fmt.Errorf("rclone binary is not available. err=%s", err)
+	}
+	logrus.Debugf("rclone version: %s", strings.Split(version, "\n")[0])
+
+	parts := strings.SplitN(strings.TrimPrefix(repo, "rclone:"), ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Invalid rclone repository %s. Use 'rclone:<remote>:<path>'", repo)
+	}
+	remote := parts[0]
+	_, err = ExecCmd("rclone", "lsd", remote+":")
+	if err != nil {
+		return fmt.Errorf("rclone remote '%s' is not accessible. err=%s", remote, err)
+	}
+
+	logrus.Infof("Using rclone repository %s", repo)
+	return nil
+}
+
+// configureSwift setup OpenStack credentials for 'swift:' repositories
+func configureSwift(r *Repository, authURL string, region string, username string, password string, tenant string, domain string) error {
+	repo := r.Repo
+	if repoBackend(repo) != "swift" {
+		return nil
+	}
+	setEnv("OS_AUTH_URL", authURL)
+	setEnv("OS_REGION_NAME", region)
+	setEnv("OS_USERNAME", username)
+	setEnv("OS_PASSWORD", password)
+	setEnv("OS_TENANT_NAME", tenant)
+	setEnv("OS_PROJECT_NAME", tenant)
+	setEnv("OS_USER_DOMAIN_NAME", domain)
+	setEnv("OS_PROJECT_DOMAIN_NAME", domain)
+
+	if r.getEnv("OS_AUTH_URL") == "" {
+		return fmt.Errorf("OpenStack auth URL is required for swift repositories")
+	}
+	if r.getEnv("OS_USERNAME") == "" || r.getEnv("OS_PASSWORD") == "" {
+		return fmt.Errorf("OpenStack username and password are required for swift repositories")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(repo, "swift:"), ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Invalid swift repository %s. Use 'swift:<container>:/<path>'", repo)
+	}
+
+	logrus.Infof("Using Swift repository %s", repo)
+	return nil
+}
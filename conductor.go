@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flaviostutz/conductor-go-client/task"
+)
+
+var (
+	// conductorURL Conductor API URL, used by calls the Conductor client doesn't have
+	conductorURL string
+
+	// taskLogs whether the restic output of tasks is added to their Conductor task logs
+	taskLogs = true
+
+	// progressUpdateTime interval between progress updates of running backups in Conductor. Disabled if 0
+	progressUpdateTime = 30 * time.Second
+
+	// shardIndex and shardCount shard of the backupNames this worker runs (0 to shardCount-1). All backupNames if shardCount is 0
+	shardIndex int
+	shardCount int
+
+	// shardRequeueSeconds delay before a task of another shard can be polled again
+	shardRequeueSeconds int64 = 1
+)
+
+// parseShard parse a '<index>/<count>' shard, with index from 0 to count-1. Empty disables sharding
+func parseShard(value string) (int, int, error) {
+	if value == "" {
+		return 0, 0, nil
+	}
+	var index, count int
+	_, err := fmt.Sscanf(value, "%d/%d", &index, &count)
+	if err != nil || count < 1 || index < 0 || index >= count {
+		return 0, 0, fmt.Errorf("Invalid shard '%s'. Use '<index>/<count>' with index from 0 to count-1", value)
+	}
+	return index, count, nil
+}
+
+// inShard whether the task backupName hashes to the shard of this worker. Tasks without a backupName run in any shard
+func inShard(t *task.Task) bool {
+	backupName := taskBackupName(t)
+	if shardCount <= 1 || backupName == "" {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(backupName))
+	return int(h.Sum32()%uint32(shardCount)) == shardIndex
+}
+
+// requeueTask return a task to the Conductor queue so that another worker polls it
+func requeueTask(t *task.Task) *task.TaskResult {
+	tr := task.NewTaskResult(t)
+	tr.Status = task.TaskResultStatus(task.IN_PROGRESS)
+	tr.CallbackAfterSeconds = shardRequeueSeconds
+	return tr
+}
+
+// checkConductor whether the Conductor API answers requests
+func checkConductor() error {
+	url := fmt.Sprintf("%s/tasks/queue/sizes?taskType=backup", strings.TrimSuffix(conductorURL, "/"))
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status=%d", resp.StatusCode)
+	}
+	return nil
+}
+
+// postTaskLog add a log entry to a task, shown in the Conductor UI
+func postTaskLog(taskID string, log string) error {
+	url := fmt.Sprintf("%s/tasks/%s/log", strings.TrimSuffix(conductorURL, "/"), taskID)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "text/plain", strings.NewReader(log))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("status=%d response=%s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// updateTaskProgress report a running task as IN_PROGRESS with a 'progress' output. Conductor only gives an IN_PROGRESS task to
+// a worker again after callbackAfter, so it must outlast the task
+func updateTaskProgress(t *task.Task, progress map[string]interface{}, callbackAfter time.Duration) error {
+	if conductorClient == nil {
+		return nil
+	}
+	tr := task.NewTaskResult(t)
+	tr.Status = task.TaskResultStatus(task.IN_PROGRESS)
+	tr.OutputData = map[string]interface{}{"progress": progress}
+	tr.CallbackAfterSeconds = int64(callbackAfter.Seconds())
+	body, err := tr.ToJSONString()
+	if err != nil {
+		return err
+	}
+	_, err = conductorClient.UpdateTask(body)
+	if err != nil {
+		addMetric("backtor_task_updates_failed_total", 1, "task", t.TaskType)
+	}
+	return err
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// envPrefix prefix of the env variables flags fall back to (ex.: BACKTOR_RESTIC_CONDUCTOR_URL for --conductor-url)
+const envPrefix = "BACKTOR_RESTIC_"
+
+// explicitFlags return the names of the flags set in the command line, even to their default value
+func explicitFlags() map[string]bool {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// flagEnv return the env variable of a flag
+func flagEnv(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// applyEnvFlags set the flags not in set from their env variables, adding them to set
+func applyEnvFlags(set map[string]bool) error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(flagEnv(f.Name))
+		if !ok || set[f.Name] || err != nil {
+			return
+		}
+		err1 := flag.Set(f.Name, value)
+		if err1 != nil {
+			err = fmt.Errorf("Invalid %s. err=%s", flagEnv(f.Name), err1)
+			return
+		}
+		set[f.Name] = true
+	})
+	return err
+}
+
+// loadConfig read a YAML config file whose keys are flag names (ex.: 'conductor-url: http://conductor:8080/api') and set the flags that
+// are not in set. Its optional 'repositories' list has the format of the repositories config file and is returned as JSON
+func loadConfig(file string, set map[string]bool) ([]byte, error) {
+	config, err := readConfig(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var repos []byte
+	for name, value := range config {
+		if name == "repositories" {
+			repos, err = json.Marshal(map[string]interface{}{"repositories": jsonValue(value)})
+			if err != nil {
+				return nil, fmt.Errorf("Invalid 'repositories' in config %s. err=%s", file, err)
+			}
+			continue
+		}
+		if name == "profiles" {
+			profiles, err := configProfiles(value, file)
+			if err != nil {
+				return nil, err
+			}
+			backupProfiles = profiles
+			continue
+		}
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("Unknown option '%s' in config %s", name, file)
+		}
+		if set[name] {
+			continue
+		}
+		v, err := configValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid '%s' in config %s. err=%s", name, file, err)
+		}
+		err = flag.Set(name, v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid '%s' in config %s. err=%s", name, file, err)
+		}
+	}
+	return repos, nil
+}
+
+// readConfig parse a YAML config file
+func readConfig(file string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read config %s. err=%s", file, err)
+	}
+	config := map[string]interface{}{}
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse config %s. err=%s", file, err)
+	}
+	return config, nil
+}
+
+// configLock guards the values reloadConfig changes while tasks read them: the reloadable flags and backupProfiles
+var configLock = &sync.RWMutex{}
+
+// reloadableFlags apply the value of the flags that can change while the worker runs. They are used by the next restic commands
+var reloadableFlags = map[string]func(value string) error{
+	"log-level": func(v string) error {
+		setLogLevel(v)
+		return nil
+	},
+	"limit-upload": func(v string) error {
+		kb, err := strconv.Atoi(v)
+		if err == nil {
+			defaultBandwidth.upload = kb
+		}
+		return err
+	},
+	"limit-download": func(v string) error {
+		kb, err := strconv.Atoi(v)
+		if err == nil {
+			defaultBandwidth.download = kb
+		}
+		return err
+	},
+	"restic-verbosity": func(v string) error {
+		verbosity, err := parseVerbosity(v)
+		if err == nil {
+			defaultVerbosity = verbosity
+		}
+		return err
+	},
+	"restic-retries": func(v string) error {
+		retries, err := strconv.Atoi(v)
+		if err == nil {
+			resticRetries = retries
+		}
+		return err
+	},
+	"restic-retry-backoff-seconds": func(v string) error {
+		seconds, err := strconv.Atoi(v)
+		if err == nil {
+			resticRetryBackoff = time.Duration(seconds) * time.Second
+		}
+		return err
+	},
+	"stale-lock-minutes": func(v string) error {
+		minutes, err := strconv.Atoi(v)
+		if err == nil {
+			staleLockAge = time.Duration(minutes) * time.Minute
+		}
+		return err
+	},
+	//the flags are the lists themselves
+	"exclude": func(v string) error {
+		return nil
+	},
+	"exclude-if-present": func(v string) error {
+		return nil
+	},
+	"task-priorities": func(v string) error {
+		priorities, err := parseTaskPriorities(v)
+		if err == nil {
+			taskPriorities = priorities
+		}
+		return err
+	},
+}
+
+// reloadOnSignal read the config file again on SIGHUP and apply the reloadable flags that are not in set. Running tasks are not interrupted
+func reloadOnSignal(file string, set map[string]bool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if file == "" {
+			logrus.Warnf("Received SIGHUP but no '--config' is set. Nothing to reload")
+			continue
+		}
+		logrus.Infof("Received SIGHUP. Reloading config %s", file)
+		err := reloadConfig(file, set)
+		if err != nil {
+			logrus.Errorf("Couldn't reload config. Keeping current values. err=%s", err)
+		}
+	}
+}
+
+// reloadConfig apply the reloadable flags of the config file that changed
+func reloadConfig(file string, set map[string]bool) error {
+	config, err := readConfig(file)
+	if err != nil {
+		return err
+	}
+	profiles, err := configProfiles(config["profiles"], file)
+	if err != nil {
+		return err
+	}
+	values := map[string]string{}
+	for name, value := range config {
+		f := flag.Lookup(name)
+		if name == "repositories" || name == "profiles" || f == nil || set[name] {
+			continue
+		}
+		v, err := configValue(value)
+		if err != nil {
+			return fmt.Errorf("Invalid '%s' in config %s. err=%s", name, file, err)
+		}
+		if v == f.Value.String() {
+			continue
+		}
+		_, ok := reloadableFlags[name]
+		if !ok {
+			logrus.Warnf("'%s' changed in config %s. It requires a restart", name, file)
+			continue
+		}
+		values[name] = v
+	}
+	configLock.Lock()
+	defer configLock.Unlock()
+	for name, v := range values {
+		//list flags append the values they are set to
+		list, ok := flag.Lookup(name).Value.(*listFlag)
+		if ok {
+			*list = listFlag{}
+		}
+		err = flag.Set(name, v)
+		if err == nil {
+			err = reloadableFlags[name](v)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid '%s' in config %s. err=%s", name, file, err)
+		}
+		logrus.Infof("Reloaded '%s'", name)
+	}
+	backupProfiles = profiles
+	logrus.Infof("Reloaded %d backup profiles", len(profiles))
+	return nil
+}
+
+// configProfiles parse the 'profiles' list of the config file. Empty if value is nil
+func configProfiles(value interface{}, file string) ([]*BackupProfile, error) {
+	if value == nil {
+		return []*BackupProfile{}, nil
+	}
+	data, err := json.Marshal(jsonValue(value))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid 'profiles' in config %s. err=%s", file, err)
+	}
+	return parseProfiles(data, file)
+}
+
+// configValue convert a YAML scalar or list of scalars to a flag value. Lists are comma separated
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, i := range v {
+			s, err := configValue(i)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, s)
+		}
+		return strings.Join(values, ","), nil
+	case map[interface{}]interface{}:
+		return "", fmt.Errorf("A value or list is expected")
+	}
+	return fmt.Sprintf("%v", value), nil
+}
+
+// jsonValue convert the maps decoded from YAML to maps with string keys, so they can be encoded as JSON
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, i := range v {
+			m[fmt.Sprintf("%v", k)] = jsonValue(i)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+	}
+	return value
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RedisLocker lock repositories across worker replicas with Redis keys that expire unless the holder refreshes them
+type RedisLocker struct {
+	addr     string
+	password string
+	db       int
+	ttl      time.Duration
+}
+
+// distLocker locker shared by the worker replicas. nil if distributed locks are not configured
+var distLocker *RedisLocker
+
+// distLockPoll how often a held lock is checked again while waiting for it
+var distLockPoll = 2 * time.Second
+
+// refreshScript extend the lock ttl only if it is still held by the owner
+const refreshScript = "if redis.call('get', KEYS[1]) == ARGV[1] then return redis.call('pexpire', KEYS[1], ARGV[2]) else return 0 end"
+
+// releaseScript delete the lock only if it is still held by the owner
+const releaseScript = "if redis.call('get', KEYS[1]) == ARGV[1] then return redis.call('del', KEYS[1]) else return 0 end"
+
+// NewRedisLocker create a locker using the Redis server at addr (host:port)
+func NewRedisLocker(addr string, password string, db int, ttl time.Duration) (*RedisLocker, error) {
+	l := &RedisLocker{addr: addr, password: password, db: db, ttl: ttl}
+	resp, err := l.command("PING")
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't connect to Redis %s. err=%s", addr, err)
+	}
+	if resp != "PONG" {
+		return nil, fmt.Errorf("Unexpected Redis %s PING response %v", addr, resp)
+	}
+	logrus.Infof("Using Redis %s for distributed repository locks", addr)
+	return l, nil
+}
+
+// distributedLock wait until no other worker replica holds the lock of the repository and hold it until the returned func is called
+func (r *Repository) distributedLock(ctx context.Context) (func(), error) {
+	if distLocker == nil {
+		return func() {}, nil
+	}
+	//append-only repositories and their delete repository point to the same data
+	url := r.Repo
+	if r.deleteRepo != nil {
+		url = r.deleteRepo.Repo
+	}
+	sum := sha1.Sum([]byte(url))
+	key := "backtor-restic:lock:" + hex.EncodeToString(sum[:])
+	startTime := time.Now()
+	release, err := distLocker.acquire(ctx, key)
+	observeMetric("backtor_lock_wait_seconds", time.Since(startTime), "lock", "distributed")
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get distributed lock of repository %s. err=%s", r.Name, err)
+	}
+	return release, nil
+}
+
+// acquire wait for key to be free, set it and keep refreshing it until released
+func (l *RedisLocker) acquire(ctx context.Context, key string) (func(), error) {
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+	ttl := strconv.FormatInt(int64(l.ttl/time.Millisecond), 10)
+	startTime := time.Now()
+	for {
+		resp, err := l.command("SET", key, owner, "NX", "PX", ttl)
+		if err != nil {
+			return nil, err
+		}
+		if resp == "OK" {
+			break
+		}
+		logrus.Debugf("Repository lock %s is held by another worker. Waiting", key)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Stopped waiting after %s. err=%s", time.Since(startTime).Round(time.Second), ctx.Err())
+		case <-time.After(distLockPoll):
+		}
+	}
+	logrus.Debugf("Got repository lock %s after %s", key, time.Since(startTime).Round(time.Second))
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(l.ttl / 3):
+			}
+			resp, err := l.command("EVAL", refreshScript, "1", key, owner, ttl)
+			if err != nil {
+				logrus.Warnf("Couldn't refresh repository lock %s. err=%s", key, err)
+			} else if resp == int64(0) {
+				logrus.Warnf("Repository lock %s expired before being refreshed", key)
+			}
+		}
+	}()
+	release := func() {
+		close(done)
+		_, err := l.command("EVAL", releaseScript, "1", key, owner)
+		if err != nil {
+			logrus.Warnf("Couldn't release repository lock %s. It will expire in %s. err=%s", key, l.ttl, err)
+		}
+	}
+	return release, nil
+}
+
+// command run a Redis command on a new connection and return its reply
+func (l *RedisLocker) command(args ...string) (interface{}, error) {
+	conn, err := net.DialTimeout("tcp", l.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	if l.password != "" {
+		_, err = redisRequest(conn, reader, "AUTH", l.password)
+		if err != nil {
+			return nil, fmt.Errorf("Redis AUTH failed. err=%s", err)
+		}
+	}
+	if l.db != 0 {
+		_, err = redisRequest(conn, reader, "SELECT", strconv.Itoa(l.db))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return redisRequest(conn, reader, args...)
+}
+
+// redisRequest write a command in the Redis protocol (RESP) and read its reply
+func redisRequest(w io.Writer, r *bufio.Reader, args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := io.WriteString(w, b.String())
+	if err != nil {
+		return nil, err
+	}
+	return redisReply(r)
+}
+
+// redisReply read a RESP reply. nil bulk strings and arrays are returned as nil
+func redisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("Empty Redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("%s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			values[i], err = redisReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("Invalid Redis reply '%s'", line)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"compress/bzip2"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// resticDownloadURL restic release asset for a version, OS and arch
+var resticDownloadURL = "https://github.com/restic/restic/releases/download/v%s/restic_%s_%s_%s.bz2"
+
+// downloadRestic download the restic release version for the current OS/arch into dir, verify the SHA256 of the release asset and return the path of the extracted binary. Assets already downloaded with a matching checksum are reused
+func downloadRestic(version string, checksum string, dir string) (string, error) {
+	version = strings.TrimPrefix(version, "v")
+	checksum = strings.ToLower(strings.TrimSpace(checksum))
+	url := fmt.Sprintf(resticDownloadURL, version, version, runtime.GOOS, runtime.GOARCH)
+	logrus.Infof("downloadRestic() version=%s url=%s", version, url)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create restic download dir %s. err=%s", dir, err)
+	}
+	asset := filepath.Join(dir, filepath.Base(url))
+	binary := filepath.Join(dir, fmt.Sprintf("restic_%s", version))
+
+	sum, err := fileSHA256(asset)
+	if err != nil || sum != checksum {
+		err = downloadFile(url, asset)
+		if err != nil {
+			return "", err
+		}
+		sum, err = fileSHA256(asset)
+		if err != nil {
+			return "", err
+		}
+		if sum != checksum {
+			os.Remove(asset)
+			return "", fmt.Errorf("Checksum of %s doesn't match. expected=%s got=%s", url, checksum, sum)
+		}
+	} else {
+		logrus.Debugf("Using previously downloaded %s", asset)
+	}
+
+	err = extractBzip2(asset, binary)
+	if err != nil {
+		return "", err
+	}
+	logrus.Infof("restic %s downloaded to %s", version, binary)
+	return binary, nil
+}
+
+// downloadFile save the contents of url to file
+func downloadFile(url string, file string) error {
+	client := &http.Client{Timeout: 10 * time.Minute}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(workerContext))
+	if err != nil {
+		return fmt.Errorf("Couldn't download %s. err=%s", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Couldn't download %s. status=%d", url, resp.StatusCode)
+	}
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Couldn't download %s. err=%s", url, err)
+	}
+	return os.Rename(tmp, file)
+}
+
+// extractBzip2 decompress a bzip2 file into an executable file
+func extractBzip2(file string, target string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := target + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, bzip2.NewReader(in))
+	out.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Couldn't extract %s. err=%s", file, err)
+	}
+	return os.Rename(tmp, target)
+}
+
+// fileSHA256 hex SHA256 of the contents of file
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+)
+
+// error codes reported in the 'errorCode' output of failed tasks
+const (
+	ErrorTimeout            = "TIMEOUT"
+	ErrorCanceled           = "CANCELED"
+	ErrorLocked             = "REPOSITORY_LOCKED"
+	ErrorNetwork            = "NETWORK"
+	ErrorWrongPassword      = "WRONG_PASSWORD"
+	ErrorSnapshotNotFound   = "SNAPSHOT_NOT_FOUND"
+	ErrorRepositoryNotFound = "REPOSITORY_NOT_FOUND"
+	ErrorCorruptRepository  = "CORRUPT_REPOSITORY"
+	ErrorAppendOnly         = "APPEND_ONLY"
+	ErrorUnsupported        = "UNSUPPORTED"
+	ErrorInvalidInput       = "INVALID_INPUT"
+	ErrorUnknown            = "UNKNOWN"
+)
+
+// errorClass failures identified by lowercase messages and whether Conductor must not retry them
+type errorClass struct {
+	code     string
+	terminal bool
+	messages []string
+}
+
+// errorClasses checked in order. Failures that don't match any are retryable with ErrorUnknown
+var errorClasses = []errorClass{
+	{code: ErrorWrongPassword, terminal: true, messages: []string{"wrong password or no key found"}},
+	{code: ErrorRepositoryNotFound, terminal: true, messages: []string{"repository does not exist", "is there a repository at the following location", "unable to open config file"}},
+	{code: ErrorSnapshotNotFound, terminal: true, messages: []string{"no matching id found", "no snapshot found", "couldn't find snapshot"}},
+	{code: ErrorCorruptRepository, terminal: true, messages: []string{"ciphertext verification failed", "hash mismatch", "is damaged", "is corrupt"}},
+	{code: ErrorAppendOnly, terminal: true, messages: []string{"is append-only"}},
+	{code: ErrorUnsupported, terminal: true, messages: []string{"requires restic"}},
+	{code: ErrorInvalidInput, terminal: true, messages: []string{"is required as input data", "is not configured nor allowed", "invalid input data"}},
+	{code: ErrorLocked, terminal: false, messages: []string{"repository is already locked", "unable to create lock"}},
+}
+
+// classifyError return the error code of a task failure and whether retrying the task can't help (wrong password, missing snapshot, corrupt repository)
+func classifyError(err error) (string, bool) {
+	_, timedOut := err.(*CmdTimeoutError)
+	if timedOut {
+		return ErrorTimeout, false
+	}
+	msg := strings.ToLower(err.Error())
+	if strings.HasPrefix(msg, "command canceled") {
+		return ErrorCanceled, false
+	}
+	for _, c := range errorClasses {
+		for _, m := range c.messages {
+			if strings.Contains(msg, m) {
+				return c.code, c.terminal
+			}
+		}
+	}
+	if isTransient(err) {
+		return ErrorNetwork, false
+	}
+	return ErrorUnknown, false
+}
@@ -4,6 +4,7 @@ go 1.12
 
 require (
 	github.com/flaviostutz/conductor-go-client v0.0.0-20190725150857-8f22638f73d2
-	github.com/go-cmd/cmd v1.0.4
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/sirupsen/logrus v1.4.2
+	gopkg.in/yaml.v2 v2.2.2
 )
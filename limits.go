@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cgroupRoot mount point of the cgroup v2 hierarchy
+var cgroupRoot = "/sys/fs/cgroup"
+
+// ResourceLimits CPU and memory caps of restic processes. Zero values are not limited
+type ResourceLimits struct {
+	CPUWeight   int
+	MemoryMaxMB int
+	cgroup      string
+}
+
+// setup create a cgroup v2 for restic processes with the limits. When cgroup v2 is not available or writable, memory is capped
+// with an rlimit on restic processes instead and CPU is not limited
+func (l *ResourceLimits) setup() error {
+	if l.CPUWeight < 0 || l.CPUWeight > 10000 {
+		return fmt.Errorf("CPU weight must be between 1 and 10000")
+	}
+	dir, err := l.createCgroup()
+	if err == nil {
+		l.cgroup = dir
+		logrus.Infof("restic processes run in cgroup %s. cpuWeight=%d memoryMaxMB=%d", dir, l.CPUWeight, l.MemoryMaxMB)
+		return nil
+	}
+	if l.MemoryMaxMB <= 0 {
+		return fmt.Errorf("Couldn't create cgroup for restic processes. err=%s", err)
+	}
+	logrus.Warnf("Couldn't create cgroup for restic processes. Limiting their memory with rlimits only. err=%s", err)
+	if l.CPUWeight > 0 {
+		logrus.Warnf("CPU weight of restic processes is not limited without cgroups")
+	}
+	return nil
+}
+
+// createCgroup create a 'restic' cgroup next to the worker own cgroup. The worker is moved to a 'worker' leaf cgroup, as cgroup v2
+// only enables controllers for children of cgroups without processes
+func (l *ResourceLimits) createCgroup() (string, error) {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	current := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			current = strings.TrimPrefix(line, "0::")
+		}
+	}
+	if current == "" {
+		return "", fmt.Errorf("cgroup v2 is not in use")
+	}
+	base := filepath.Join(cgroupRoot, current)
+	if filepath.Base(base) == "worker" {
+		//already moved by a previous setup
+		base = filepath.Dir(base)
+	}
+
+	controllers, err := ioutil.ReadFile(filepath.Join(base, "cgroup.controllers"))
+	if err != nil {
+		return "", err
+	}
+	enable := []string{}
+	if l.CPUWeight > 0 {
+		enable = append(enable, "cpu")
+	}
+	if l.MemoryMaxMB > 0 {
+		enable = append(enable, "memory")
+	}
+	available := " " + strings.TrimSpace(string(controllers)) + " "
+	for _, c := range enable {
+		if !strings.Contains(available, " "+c+" ") {
+			return "", fmt.Errorf("cgroup controller %s is not available in %s", c, base)
+		}
+	}
+
+	worker := filepath.Join(base, "worker")
+	err = os.MkdirAll(worker, 0755)
+	if err != nil {
+		return "", err
+	}
+	err = writeCgroupFile(worker, "cgroup.procs", strconv.Itoa(os.Getpid()))
+	if err != nil {
+		return "", err
+	}
+	for _, c := range enable {
+		err = writeCgroupFile(base, "cgroup.subtree_control", "+"+c)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	dir := filepath.Join(base, "restic")
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	if l.CPUWeight > 0 {
+		err = writeCgroupFile(dir, "cpu.weight", strconv.Itoa(l.CPUWeight))
+		if err != nil {
+			return "", err
+		}
+	}
+	if l.MemoryMaxMB > 0 {
+		err = writeCgroupFile(dir, "memory.max", strconv.FormatInt(int64(l.MemoryMaxMB)*1024*1024, 10))
+		if err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// apply move a started restic process to the restic cgroup, or cap its memory with an rlimit when there is no cgroup.
+// Processes it starts afterwards (ex.: rclone, ssh) inherit the limits
+func (l *ResourceLimits) apply(pid int) {
+	if l.cgroup != "" {
+		err := writeCgroupFile(l.cgroup, "cgroup.procs", strconv.Itoa(pid))
+		if err != nil {
+			logrus.Warnf("Couldn't move restic process %d to cgroup %s. err=%s", pid, l.cgroup, err)
+		}
+		return
+	}
+	if l.MemoryMaxMB > 0 {
+		max := uint64(l.MemoryMaxMB) * 1024 * 1024
+		lim := syscall.Rlimit{Cur: max, Max: max}
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), syscall.RLIMIT_DATA, uintptr(unsafe.Pointer(&lim)), 0, 0, 0)
+		if errno != 0 {
+			logrus.Warnf("Couldn't limit memory of restic process %d. err=%s", pid, errno)
+		}
+	}
+}
+
+func writeCgroupFile(dir string, name string, value string) error {
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't write %s to %s. err=%s", value, filepath.Join(dir, name), err)
+	}
+	return nil
+}
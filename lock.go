@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RepoLock serialize the tasks of a repository. Tasks that need an exclusive restic lock (ex.: forget, prune, key changes) hold it
+// exclusively, while other tasks run concurrently except with tasks of the same backupName. Waiting tasks get the lock by priority
+// and then in arrival order, so a burst of one task type doesn't starve the others
+type RepoLock struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	readers   int
+	writer    bool
+	queue     []*lockWaiter
+	names     map[string]*nameLock
+	namesLock sync.Mutex
+}
+
+// lockWaiter task waiting for a RepoLock
+type lockWaiter struct {
+	exclusive bool
+	priority  int
+	granted   bool
+}
+
+// nameLock lock of a backupName and the number of tasks holding or waiting for it
+type nameLock struct {
+	lock  sync.Mutex
+	users int
+}
+
+// taskPriorities priority of task types waiting for a repository lock. Unlisted types have priority 0
+var taskPriorities = map[string]int{}
+
+// parseTaskPriorities parse comma separated '<task type>=<priority>' values
+func parseTaskPriorities(value string) (map[string]int, error) {
+	priorities := map[string]int{}
+	for _, p := range strings.Split(value, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid task priority '%s'. Use '<task type>=<priority>'", p)
+		}
+		priority, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid task priority '%s'. err=%s", p, err)
+		}
+		priorities[strings.TrimSpace(kv[0])] = priority
+	}
+	return priorities, nil
+}
+
+// repoLocks lock of each repository url, shared by all Repository values using it (configured, requested by tasks or delete repositories)
+var repoLocks = map[string]*RepoLock{}
+var repoLocksLock = &sync.Mutex{}
+
+// repoLock return the lock of a repository url, creating it on first use
+func repoLock(url string) *RepoLock {
+	repoLocksLock.Lock()
+	defer repoLocksLock.Unlock()
+	l, ok := repoLocks[url]
+	if !ok {
+		l = NewRepoLock()
+		repoLocks[url] = l
+	}
+	return l
+}
+
+// shareRepoLock make a repository url use the lock of another repository, as when both point to the same storage
+func shareRepoLock(url string, lock *RepoLock) {
+	repoLocksLock.Lock()
+	defer repoLocksLock.Unlock()
+	repoLocks[url] = lock
+}
+
+// NewRepoLock create an unlocked repository lock
+func NewRepoLock() *RepoLock {
+	l := &RepoLock{names: map[string]*nameLock{}}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+// Lock wait for all tasks of the repository to finish and hold it exclusively
+func (l *RepoLock) Lock(priority int) {
+	l.acquire(true, priority)
+}
+
+// Unlock release an exclusive lock
+func (l *RepoLock) Unlock() {
+	l.release(true)
+}
+
+// RLock hold the repository along with other tasks, waiting only for exclusive tasks. Used by tasks that only read the repository
+func (l *RepoLock) RLock(priority int) {
+	l.acquire(false, priority)
+}
+
+// RUnlock release a lock obtained with RLock
+func (l *RepoLock) RUnlock() {
+	l.release(false)
+}
+
+// RLockName hold the repository along with other tasks, waiting for tasks of the same backupName. Empty names only wait for exclusive tasks
+func (l *RepoLock) RLockName(name string, priority int) {
+	l.acquire(false, priority)
+	if name == "" {
+		return
+	}
+	l.namesLock.Lock()
+	n, ok := l.names[name]
+	if !ok {
+		n = &nameLock{}
+		l.names[name] = n
+	}
+	n.users = n.users + 1
+	l.namesLock.Unlock()
+	n.lock.Lock()
+}
+
+// RUnlockName release a lock obtained with RLockName
+func (l *RepoLock) RUnlockName(name string) {
+	if name != "" {
+		l.namesLock.Lock()
+		n := l.names[name]
+		n.users = n.users - 1
+		if n.users == 0 {
+			delete(l.names, name)
+		}
+		l.namesLock.Unlock()
+		n.lock.Unlock()
+	}
+	l.release(false)
+}
+
+// acquire queue the task after the waiting ones of the same or higher priority and wait for its turn
+func (l *RepoLock) acquire(exclusive bool, priority int) {
+	startTime := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	w := &lockWaiter{exclusive: exclusive, priority: priority}
+	i := len(l.queue)
+	for i > 0 && l.queue[i-1].priority < priority {
+		i = i - 1
+	}
+	l.queue = append(l.queue, nil)
+	copy(l.queue[i+1:], l.queue[i:])
+	l.queue[i] = w
+	l.grant()
+	for !w.granted {
+		l.cond.Wait()
+	}
+	observeMetric("backtor_lock_wait_seconds", time.Since(startTime), "lock", "repository")
+}
+
+// release release a lock and let the next waiting tasks run
+func (l *RepoLock) release(exclusive bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if exclusive {
+		l.writer = false
+	} else {
+		l.readers = l.readers - 1
+	}
+	l.grant()
+}
+
+// grant give the lock to the waiting tasks at the head of the queue while they are compatible with the running ones
+func (l *RepoLock) grant() {
+	granted := false
+	for len(l.queue) > 0 {
+		w := l.queue[0]
+		if l.writer || (w.exclusive && l.readers > 0) {
+			break
+		}
+		if w.exclusive {
+			l.writer = true
+		} else {
+			l.readers = l.readers + 1
+		}
+		w.granted = true
+		granted = true
+		l.queue = l.queue[1:]
+	}
+	if granted {
+		l.cond.Broadcast()
+	}
+}
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	conductor "github.com/flaviostutz/conductor-go-client"
@@ -15,48 +26,239 @@ import (
 )
 
 var (
-	sourcePath     string
-	repoDir        string
-	resticPassword string
-	repoLock       = &sync.Mutex{}
+	sourcePath         string
+	sourceDirTemplate  = "{sourcePath}/{backupName}"
+	repoDir            string
+	resticPassword     string
+	copyRepoDir        string
+	copyResticPassword string
+
+	//workerContext is canceled on shutdown, stopping restic commands that are still running
+	workerContext, stopWorker = context.WithCancel(context.Background())
+
+	//contexts of running tasks by task id, canceled when Conductor no longer wants the task
+	taskContexts        = map[string]context.Context{}
+	taskContextsLock    = &sync.Mutex{}
+	conductorClient     *conductor.ConductorHttpClient
+	taskStatusCheckTime = 30 * time.Second
+
+	//hostname of the snapshots of backups without a 'host' input or profile host. restic uses the worker hostname if empty
+	snapshotHost string
+
+	//backup options of tasks without the input or a profile setting it
+	oneFileSystem     bool
+	excludeCaches     bool
+	excludeLargerThan string
+	ignoreInode       bool
+	ignoreCtime       bool
+
+	//tags of the snapshots of every backup, besides the ones of profiles and the 'tags' input
+	defaultTags = listFlag{}
+
+	//exclude patterns of every backup, besides the ones of profiles and the 'excludes' input
+	defaultExcludes = listFlag{}
+
+	//marker files (ex.: '.nobackup') excluding their dirs from every backup, besides the ones of profiles and the 'excludeIfPresent' input
+	defaultExcludeIfPresent = listFlag{}
+
+	//name of the ignore files (ex.: '.resticignore') with exclude patterns of their dirs, looked up in the source dirs of backups. Disabled if empty
+	ignoreFileName string
+
+	//base dirs of the dirs tasks may back up with the 'sourcePath' input
+	allowedSourcePaths = []string{}
+
+	//extended option keys tasks may set with the 'resticOptions' input
+	allowedTaskOptions = []string{}
+
+	//last lines of restic output returned in the 'resticOutput' of failed tasks
+	failureOutputLines = 20
+
+	//timeout of backups without a 'timeout' input or profile timeout
+	defaultBackupTimeout = 1 * time.Hour
+
+	//timeout of restore, check, prune, copy, repairIndex, migrate and rewrite tasks without a 'timeout' input
+	defaultTaskTimeout = 1 * time.Hour
+
+	//timeout of remove tasks without a 'timeout' input
+	defaultRemoveTimeout = 90 * time.Second
+
+	//don't create repositories that can't be accessed on startup
+	noInit = false
+
+	//max size of the local restic cache. Not limited if 0
+	maxCacheSizeMB = 0
+
+	//interval between checks of the local restic cache size
+	cacheCheckTime = 5 * time.Minute
 )
 
 func main() {
+	taskStatusCheckSeconds := flag.Int("task-status-check-seconds", 30, "Interval for checking in Conductor whether running tasks were canceled or timed out, stopping their restic commands. Disabled if 0")
+	resticBin := flag.String("restic-bin", "restic", "Restic binary name looked up in PATH, or path to it")
+	resticDownloadVersion := flag.String("restic-download-version", "", "restic release (ex.: '0.16.4') downloaded for the current OS/arch at startup and used instead of '--restic-bin'. Disabled if empty")
+	resticDownloadSHA256 := flag.String("restic-download-sha256", "", "Pinned SHA256 of the downloaded restic release asset (restic_<version>_<os>_<arch>.bz2). Required with '--restic-download-version'")
+	resticDownloadDir := flag.String("restic-download-dir", "/var/cache/backtor-restic", "Dir where the downloaded restic release is kept")
+	resticMinVersion := flag.String("restic-min-version", "0.9.5", "Minimum restic version. The worker doesn't start with older versions")
+	noInit0 := flag.Bool("no-init", false, "Don't create repositories that can't be accessed on startup. The worker exits instead, so a wrong location or password doesn't silently create an empty repository")
+	resticCacheDir0 := flag.String("restic-cache-dir", "", "Dir of the local restic cache. Defaults to RESTIC_CACHE_DIR env or restic default (~/.cache/restic)")
+	maxCacheSizeMB0 := flag.Int("max-cache-size-mb", 0, "Max size of the local restic cache. The least recently used repository caches are removed when it is bigger. Not limited if 0")
+	resticCPUWeight := flag.Int("restic-cpu-weight", 0, "cgroup v2 CPU weight (1-10000, 100 is the default weight of other processes) of restic processes. Not limited if 0")
+	resticMemoryMaxMB := flag.Int("restic-memory-max-mb", 0, "Max memory of restic processes. Uses cgroup v2, or an rlimit when cgroups are not writable. Not limited if 0")
+	resticNice := flag.Int("restic-nice", 0, "Niceness (1-19) of restic processes, so backups of hot volumes don't compete for CPU with the workload. Unchanged if 0")
+	resticIONice := flag.String("restic-ionice", "", "IO scheduling class of restic processes: 'idle' or 'best-effort:<0-7>'. Unchanged if empty")
+	limitUploadKB := flag.Int("limit-upload", 0, "Upload bandwidth limit of restic in KiB/s. Tasks may override it with the 'limitUploadKB' input. Not limited if 0")
+	limitDownloadKB := flag.Int("limit-download", 0, "Download bandwidth limit of restic in KiB/s. Tasks may override it with the 'limitDownloadKB' input. Not limited if 0")
+	pidDir := flag.String("pid-dir", "/var/run/backtor-restic", "Dir where running restic processes are registered. On startup, restic processes left behind by a crashed worker are stopped and stale repository locks are removed. Disabled if empty")
+	maxConcurrentRestic := flag.Int("max-concurrent-restic", 0, "Max restic processes running at the same time. Other commands wait for one to finish. 0 means unbounded")
+	staleLockMinutes := flag.Int("stale-lock-minutes", 30, "Minutes after which repository locks of other hosts are considered stale and removed before tasks. Locks of restic processes of this host that are no longer running are always stale")
+	shard := flag.String("shard", "", "Shard '<index>/<count>' (index from 0) of the backupNames this worker runs, when several workers poll the same tasks. Tasks of other backupNames are returned to Conductor")
+	taskPriorities0 := flag.String("task-priorities", "", "Comma separated task type priorities used when tasks wait for a repository (ex.: 'backup=10,remove=-5'). Default 0. Same priority tasks run in arrival order")
+	redisAddr := flag.String("redis-addr", "", "Redis address (host:port) used to lock repositories shared by several worker replicas during backups and operations that delete data")
+	redisPassword := flag.String("redis-password", "", "Redis password. Defaults to REDIS_PASSWORD env")
+	redisDB := flag.Int("redis-db", 0, "Redis database of the repository locks")
+	distLockTTLSeconds := flag.Int("distributed-lock-ttl-seconds", 60, "Seconds a repository lock of a crashed worker replica is kept in Redis. Held locks are refreshed every third of it")
+	defaultBackupTimeout0 := flag.Duration("default-backup-timeout", 1*time.Hour, "Timeout of backups (ex.: '45m') without a 'timeout' input or profile 'timeoutSeconds'")
+	defaultTaskTimeout0 := flag.Duration("default-task-timeout", 1*time.Hour, "Timeout of restore, check, prune, copy, dump, ls, repairIndex, migrate and rewrite tasks (ex.: '3h') without a 'timeout' input")
+	defaultRemoveTimeout0 := flag.Duration("default-remove-timeout", 90*time.Second, "Timeout of remove tasks without a 'timeout' input")
+	resticRetries0 := flag.Int("restic-retries", 3, "Times a restic command is run again when it fails with a transient error (network, backend 5xx, locked repository)")
+	resticRetryBackoffSeconds := flag.Int("restic-retry-backoff-seconds", 5, "Wait before retrying a restic command. It doubles on each retry, up to 5 minutes")
+	snapshotHost0 := flag.String("snapshot-host", "", "Hostname of the snapshots of backups ('restic backup --host'), so snapshots of workers with random container hostnames are grouped together. Defaults to the worker hostname")
+	oneFileSystem0 := flag.Bool("one-file-system", false, "Don't cross filesystem boundaries of the backup source dir, so volumes mounted inside it aren't backed up. Tasks may override it with the 'oneFileSystem' input")
+	excludeCaches0 := flag.Bool("exclude-caches", false, "Don't back up dirs with a CACHEDIR.TAG file. Tasks may override it with the 'excludeCaches' input")
+	excludeLargerThan0 := flag.String("exclude-larger-than", "", "Don't back up files larger than this size (ex.: '2G'). Tasks may override it with the 'excludeLargerThan' input")
+	ignoreInode0 := flag.Bool("ignore-inode", false, "Don't rescan files whose inode changed, for filesystems with unstable inodes (ex.: some network filesystems). Tasks may override it with the 'ignoreInode' input")
+	ignoreCtime0 := flag.Bool("ignore-ctime", false, "Don't rescan files whose ctime changed (restic >= 0.12), for filesystems with unstable ctimes (ex.: container overlayfs). Tasks may override it with the 'ignoreCtime' input")
+	flag.Var(&defaultTags, "tag", "Tag added to the snapshots of every backup. May be repeated or comma separated")
+	flag.Var(&defaultExcludes, "exclude", "restic '--exclude' pattern of every backup. May be repeated or comma separated")
+	flag.Var(&defaultExcludeIfPresent, "exclude-if-present", "Dirs containing this file (restic '--exclude-if-present', ex.: '.nobackup') are not backed up. May be repeated or comma separated")
+	ignoreFileName0 := flag.String("ignore-file-name", "", "Name of files (ex.: '.resticignore') with exclude patterns, one per line, of the dir they are in. They are looked up in the source dirs of every backup. Disabled if empty")
+	resticOpts := listFlag{}
+	flag.Var(&resticOpts, "restic-opt", "Extended restic option ('key=value', ex.: 's3.connections=16') passed as '-o' to every command. May be repeated or comma separated")
+	allowedTaskResticOpts := flag.String("allowed-task-restic-opts", "s3.connections,b2.connections,azure.connections,gs.connections,swift.connections,rest.connections,sftp.connections", "Comma separated list of extended option keys tasks may set with the 'resticOptions' input")
+	packSizeMB := flag.Int("pack-size", 0, "Target size in MiB (4-128) of the pack files restic writes (restic >= 0.14). Bigger packs reduce requests to object storage and prune time of large repositories. restic default (16) if 0")
+	compression := flag.String("compression", "", "Compression of the data written to repositories of format version 2 (restic >= 0.14): 'auto', 'max' or 'off'. Tasks may override it with the 'compression' input. restic default if empty")
+	resticVerbosity0 := flag.String("restic-verbosity", "normal", "restic verbosity, independent of '--log-level': 'quiet', 'normal', 'verbose' or 'verbose=<1-3>'. Tasks may override it with the 'resticVerbosity' input")
+	repoSizeRefreshSeconds := flag.Int("repo-size-refresh-seconds", 3600, "How long the repository size returned by backup tasks is estimated from the data they add before 'restic stats' is run again. Always run if 0")
+	statusAddr := flag.String("status-addr", ":4000", "Address of the HTTP server with the '/status' endpoint. Disabled if empty")
+	configFile := flag.String("config", "", "YAML file with flag values by flag name and 'repositories'. Flags set in the command line override it")
 	logLevel := flag.String("log-level", "debug", "debug, info, warning, error")
 	conductorURL0 := flag.String("conductor-url", "", "Conductor API URL")
+	progressUpdateSeconds := flag.Int("progress-update-seconds", 30, "Interval between progress updates of running backups in Conductor. Disabled if 0")
+	taskThreads := flag.Int("task-threads", 1, "Tasks of each type run concurrently. Tasks of the same repository that delete data run alone, and tasks of the same backupName one at a time")
+	taskLogs0 := flag.Bool("task-logs", true, "Add the restic commands run by each task and their output (last 64KB) to the task logs in Conductor")
 	sourcePath0 := flag.String("source-path", "/backup-source", "Backup source path")
-	repoDir0 := flag.String("repo-dir", "/backup-repo", "Restic repository of backups")
-	resticPassword0 := flag.String("restic-password", "", "Restic repository password")
+	sourceDirTemplate0 := flag.String("source-dir-template", "{sourcePath}/{backupName}", "Dir backed up for each backupName. '{sourcePath}' is replaced by '--source-path' and '{backupName}' by the task backupName")
+	repoDir0 := flag.String("repo-dir", "", "Restic repository of backups. Defaults to RESTIC_REPOSITORY env or '/backup-repo'")
+	resticPassword0 := flag.String("restic-password", "", "Restic repository password. Defaults to RESTIC_PASSWORD env")
+	resticPasswordFile := flag.String("restic-password-file", "", "File containing the Restic repository password. Defaults to RESTIC_PASSWORD_FILE env")
+	resticPasswordCommand := flag.String("restic-password-command", "", "Command whose output is the Restic repository password. Used when no password is set")
+	resticPasswordCommandTTL := flag.Int("restic-password-command-ttl", 300, "Seconds the password obtained from '--restic-password-command' is cached before running the command again")
+	reposConfigFile := flag.String("repos-config-file", "", "JSON file with additional repositories and the backupName prefixes/tags routed to them")
+	secretsDir := flag.String("secrets-dir", "", "Dir with one sub dir per repository name containing a 'password' file and backend credential files named after restic env variables")
+	vaultAddr := flag.String("vault-addr", "", "HashiCorp Vault address used to read repository passwords and backend credentials. Defaults to VAULT_ADDR env")
+	vaultToken := flag.String("vault-token", "", "Vault token. Defaults to VAULT_TOKEN env")
+	vaultRoleID := flag.String("vault-role-id", "", "Vault AppRole role id. Used when no token is set")
+	vaultSecretID := flag.String("vault-secret-id", "", "Vault AppRole secret id")
+	vaultK8sRole := flag.String("vault-k8s-role", "", "Vault Kubernetes auth role. Used when no token or AppRole is set")
+	vaultK8sTokenFile := flag.String("vault-k8s-token-file", "/var/run/secrets/kubernetes.io/serviceaccount/token", "Kubernetes service account token file used for Vault Kubernetes auth")
+	vaultAuthPath := flag.String("vault-auth-path", "", "Mount path of the Vault auth method. Defaults to 'approle' or 'kubernetes'")
+	vaultCACertFile := flag.String("vault-ca-cert-file", "", "CA certificate file used to verify the Vault server. Defaults to VAULT_CACERT env")
+	vaultPath := flag.String("vault-path", "", "Vault secret path (ex.: 'secret/data/backups') with the 'password' and backend credentials of the default repository")
+	vaultSecretsTTL0 := flag.Int("vault-secrets-ttl", 300, "Seconds Vault secrets without a lease are cached before being read again")
+	appendOnly := flag.Bool("append-only", false, "Whether '--repo-dir' is append-only (rest-server --append-only or S3 object lock). Tasks that delete data fail with a terminal error unless '--delete-repository' is set")
+	deleteRepository := flag.String("delete-repository", "", "Name of a repository from '--repos-config-file' with delete permission on '--repo-dir', used by tasks that delete data when it is append-only")
+	allowedSourcePaths0 := flag.String("allowed-source-paths", "", "Comma separated list of base dirs whose subdirs backup tasks may back up with the 'sourcePath' input")
+	allowedTaskRepos0 := flag.String("allowed-task-repos", "", "Comma separated list of repository URLs that tasks may target with the 'repo' input besides the configured repositories")
+	copyRepoDir0 := flag.String("copy-repo-dir", "", "Secondary Restic repository used as default target for copy tasks")
+	copyResticPassword0 := flag.String("copy-restic-password", "", "Secondary Restic repository password. Defaults to '--restic-password'")
+	awsAccessKeyID := flag.String("aws-access-key-id", "", "AWS access key id for s3 repositories")
+	awsSecretAccessKey := flag.String("aws-secret-access-key", "", "AWS secret access key for s3 repositories")
+	awsProfile := flag.String("aws-profile", "", "AWS profile used for s3 repositories without static keys. SSO profiles are supported. Defaults to AWS_PROFILE env")
+	awsRegion := flag.String("aws-region", "", "AWS region for s3 repositories")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3 endpoint (ex.: https://s3.amazonaws.com). When set, '--repo-dir' must be in the form 's3:<bucket>/<path>'")
+	s3PathStyle := flag.Bool("s3-path-style", false, "Use path-style bucket URLs (required by MinIO and most S3 compatible stores)")
+	s3Region := flag.String("s3-region", "", "S3 region sent to S3 compatible stores. Defaults to the region detected by restic")
+	s3CACertFile := flag.String("s3-ca-cert-file", "", "CA certificate bundle used to verify the S3 endpoint")
+	s3InsecureTLS := flag.Bool("s3-insecure-tls", false, "Skip TLS certificate verification of the S3 endpoint. Use only for testing")
+	b2AccountID := flag.String("b2-account-id", "", "Backblaze B2 account id for b2 repositories")
+	b2AccountKey := flag.String("b2-account-key", "", "Backblaze B2 account key for b2 repositories")
+	b2Connections := flag.Int("b2-connections", 0, "Max number of concurrent connections to B2. Uses restic default if 0")
+	azureAccountName := flag.String("azure-account-name", "", "Azure storage account name for azure repositories")
+	azureAccountKey := flag.String("azure-account-key", "", "Azure storage account key for azure repositories")
+	azureAccountSAS := flag.String("azure-account-sas", "", "Azure SAS token for azure repositories. Used instead of '--azure-account-key'")
+	gcsProjectID := flag.String("gcs-project-id", "", "Google Cloud project id for gs repositories")
+	gcsCredentialsFile := flag.String("gcs-credentials-file", "", "Google service account JSON file for gs repositories. Uses default credentials (workload identity) if empty")
+	gcsCredentialsJSON := flag.String("gcs-credentials-json", "", "Google service account JSON contents for gs repositories. Used instead of '--gcs-credentials-file'")
+	sftpKeyFile := flag.String("sftp-key-file", "", "SSH private key file for sftp repositories")
+	sftpPort := flag.Int("sftp-port", 0, "SSH port for sftp repositories. Uses the port from '--repo-dir' or 22 if 0")
+	sftpKnownHostsFile := flag.String("sftp-known-hosts-file", "", "SSH known_hosts file checked against the sftp server host key")
+	sftpAcceptNewHostKeys := flag.Bool("sftp-accept-new-host-keys", false, "Add unknown sftp server host keys to '--sftp-known-hosts-file' instead of failing")
+	restUsername := flag.String("rest-username", "", "Basic auth username for rest repositories")
+	restPassword := flag.String("rest-password", "", "Basic auth password for rest repositories")
+	caCertFile := flag.String("ca-cert-file", "", "Custom CA certificate file used to verify TLS repository servers")
+	tlsClientCertFile := flag.String("tls-client-cert-file", "", "PEM file with the TLS client certificate and key used to authenticate to the repository server")
+	rcloneConfigFile := flag.String("rclone-config-file", "", "rclone config file for rclone repositories. Uses rclone default if empty")
+	swiftAuthURL := flag.String("swift-auth-url", "", "OpenStack Keystone auth URL for swift repositories")
+	swiftRegion := flag.String("swift-region", "", "OpenStack region for swift repositories")
+	swiftUsername := flag.String("swift-username", "", "OpenStack username for swift repositories")
+	swiftPassword := flag.String("swift-password", "", "OpenStack password for swift repositories")
+	swiftTenant := flag.String("swift-tenant", "", "OpenStack tenant (project) name for swift repositories")
+	swiftDomain := flag.String("swift-domain", "", "OpenStack user and project domain name for swift repositories (Keystone v3)")
 	flag.Parse()
 
-	switch *logLevel {
-	case "debug":
-		logrus.SetLevel(logrus.DebugLevel)
-		break
-	case "warning":
-		logrus.SetLevel(logrus.WarnLevel)
-		break
-	case "error":
-		logrus.SetLevel(logrus.ErrorLevel)
-		break
-	default:
-		logrus.SetLevel(logrus.InfoLevel)
+	setFlags := explicitFlags()
+	err := applyEnvFlags(setFlags)
+	if err != nil {
+		logrus.Errorf("Invalid env configuration. err=%s", err)
+		panic(1)
+	}
+	var configRepositories []byte
+	if *configFile != "" {
+		cr, err := loadConfig(*configFile, setFlags)
+		if err != nil {
+			logrus.Errorf("Invalid '--config'. err=%s", err)
+			panic(1)
+		}
+		configRepositories = cr
 	}
 
+	setLogLevel(*logLevel)
+
 	sourcePath = *sourcePath0
-	repoDir = *repoDir0
-	resticPassword = *resticPassword0
+	sourceDirTemplate = *sourceDirTemplate0
+	snapshotHost = *snapshotHost0
+	oneFileSystem = *oneFileSystem0
+	excludeCaches = *excludeCaches0
+	excludeLargerThan = *excludeLargerThan0
+	ignoreInode = *ignoreInode0
+	ignoreCtime = *ignoreCtime0
+	repoDir = firstNonEmpty(*repoDir0, os.Getenv("RESTIC_REPOSITORY"), readFileEnv("RESTIC_REPOSITORY_FILE"), "/backup-repo")
+	filePassword := ""
+	if *resticPasswordFile != "" {
+		data, err := ioutil.ReadFile(*resticPasswordFile)
+		if err != nil {
+			logrus.Errorf("Couldn't read '--restic-password-file' %s. err=%s", *resticPasswordFile, err)
+			panic(1)
+		}
+		filePassword = strings.TrimSpace(string(data))
+	}
+	resticPassword = firstNonEmpty(*resticPassword0, filePassword, os.Getenv("RESTIC_PASSWORD"), readFileEnv("RESTIC_PASSWORD_FILE"))
+	copyRepoDir = *copyRepoDir0
+	copyResticPassword = *copyResticPassword0
 
 	if sourcePath == "" {
 		logrus.Errorf("'--source-path' is required")
 		panic(1)
 	}
+	if !strings.Contains(sourceDirTemplate, "{backupName}") {
+		logrus.Warnf("'--source-dir-template' %s has no {backupName}. All backups use the same source dir", sourceDirTemplate)
+	}
 	if repoDir == "" {
 		logrus.Errorf("'--repo-dir' is required")
 		panic(1)
 	}
-	if resticPassword == "" {
-		logrus.Errorf("'--restic-password' is required")
+	if resticPassword == "" && *resticPasswordCommand == "" && *secretsDir == "" && *vaultPath == "" {
+		logrus.Errorf("'--restic-password', '--restic-password-file', '--restic-password-command', '--secrets-dir', '--vault-path', RESTIC_PASSWORD or RESTIC_PASSWORD_FILE env is required")
 		panic(1)
 	}
 	if *conductorURL0 == "" {
@@ -64,161 +266,3638 @@ func main() {
 		panic(1)
 	}
 
-	logrus.Info("====Starting Restic Conductor Worker====")
+	if *resticDownloadVersion != "" {
+		if *resticDownloadSHA256 == "" {
+			logrus.Errorf("'--restic-download-sha256' is required with '--restic-download-version'")
+			panic(1)
+		}
+		bin, err := downloadRestic(*resticDownloadVersion, *resticDownloadSHA256, *resticDownloadDir)
+		if err != nil {
+			logrus.Errorf("Couldn't download restic %s. err=%s", *resticDownloadVersion, err)
+			panic(1)
+		}
+		*resticBin = bin
+	}
+	rpath, rversion, err := checkResticBinary(*resticBin)
+	if err != nil {
+		logrus.Errorf("Invalid '--restic-bin'. err=%s", err)
+		panic(1)
+	}
+	if compareVersions(rversion, *resticMinVersion) < 0 {
+		logrus.Errorf("restic %s at %s is older than the minimum version %s", rversion, rpath, *resticMinVersion)
+		panic(1)
+	}
+	resticPath = rpath
+	resticVersion = rversion
+	if ignoreCtime {
+		err = requireResticFeature("ignore-ctime")
+		if err != nil {
+			logrus.Errorf("Invalid '--ignore-ctime'. err=%s", err)
+			panic(1)
+		}
+	}
+	if excludeLargerThan != "" {
+		err = checkSize(excludeLargerThan)
+		if err != nil {
+			logrus.Errorf("Invalid '--exclude-larger-than'. err=%s", err)
+			panic(1)
+		}
+	}
+	runner := &ExecRunner{Binary: resticPath, Nice: *resticNice, IONice: *resticIONice, PidDir: *pidDir}
+	err = runner.checkPriority()
+	if err != nil {
+		logrus.Errorf("Invalid restic priority. err=%s", err)
+		panic(1)
+	}
+	if *resticCPUWeight > 0 || *resticMemoryMaxMB > 0 {
+		limits := &ResourceLimits{CPUWeight: *resticCPUWeight, MemoryMaxMB: *resticMemoryMaxMB}
+		err = limits.setup()
+		if err != nil {
+			logrus.Errorf("Invalid restic resource limits. err=%s", err)
+			panic(1)
+		}
+		runner.Limits = limits
+	}
+	if *maxConcurrentRestic > 0 {
+		runner.Slots = make(chan struct{}, *maxConcurrentRestic)
+	}
+	resticRunner = runner
+	if *resticCacheDir0 != "" {
+		err = os.MkdirAll(*resticCacheDir0, 0700)
+		if err != nil {
+			logrus.Errorf("Couldn't create '--restic-cache-dir'. err=%s", err)
+			panic(1)
+		}
+		//restic processes inherit it
+		os.Setenv("RESTIC_CACHE_DIR", *resticCacheDir0)
+	}
+	maxCacheSizeMB = *maxCacheSizeMB0
+	noInit = *noInit0
+	ignoreFileName = *ignoreFileName0
+	defaultBackupTimeout = *defaultBackupTimeout0
+	defaultTaskTimeout = *defaultTaskTimeout0
+	defaultRemoveTimeout = *defaultRemoveTimeout0
+	defaultBandwidth = bandwidthLimits{upload: *limitUploadKB, download: *limitDownloadKB}
+	resticRetries = *resticRetries0
+	staleLockAge = time.Duration(*staleLockMinutes) * time.Minute
+	shardIndex, shardCount, err = parseShard(*shard)
+	if err != nil {
+		logrus.Errorf("Invalid '--shard'. err=%s", err)
+		panic(1)
+	}
+	taskPriorities, err = parseTaskPriorities(*taskPriorities0)
+	if err != nil {
+		logrus.Errorf("Invalid '--task-priorities'. err=%s", err)
+		panic(1)
+	}
+	repoSizeRefreshTime = time.Duration(*repoSizeRefreshSeconds) * time.Second
+	defaultVerbosity, err = parseVerbosity(*resticVerbosity0)
+	if err != nil {
+		logrus.Errorf("Invalid '--restic-verbosity'. err=%s", err)
+		panic(1)
+	}
+	defaultCompression, err = parseCompression(*compression)
+	if err != nil {
+		logrus.Errorf("Invalid '--compression'. err=%s", err)
+		panic(1)
+	}
+	resticRetryBackoff = time.Duration(*resticRetryBackoffSeconds) * time.Second
 
-	initRepo()
+	defaultRepository = NewRepository("default", repoDir, resticPassword)
+	if resticPassword == "" {
+		defaultRepository.PasswordCommand = *resticPasswordCommand
+		defaultRepository.PasswordCommandTTL = *resticPasswordCommandTTL
+	}
+	defaultRepository.VaultPath = *vaultPath
+	defaultRepository.AppendOnly = *appendOnly
+	defaultRepository.DeleteRepository = *deleteRepository
+	if *resticPassword0 == "" && filePassword != "" {
+		defaultRepository.passwordFile = *resticPasswordFile
+	} else if *resticPassword0 == "" && os.Getenv("RESTIC_PASSWORD") == "" && os.Getenv("RESTIC_PASSWORD_FILE") != "" {
+		defaultRepository.passwordFile = os.Getenv("RESTIC_PASSWORD_FILE")
+	}
+	if *reposConfigFile != "" {
+		repos, err := loadRepositories(*reposConfigFile)
+		if err != nil {
+			logrus.Errorf("Invalid repositories config. err=%s", err)
+			panic(1)
+		}
+		repositories = repos
+	} else if configRepositories != nil {
+		repos, err := parseRepositories(configRepositories, *configFile)
+		if err != nil {
+			logrus.Errorf("Invalid repositories config. err=%s", err)
+			panic(1)
+		}
+		repositories = repos
+	}
+	err = resolveDeleteRepositories()
+	if err != nil {
+		logrus.Errorf("Invalid repositories config. err=%s", err)
+		panic(1)
+	}
+	for _, sp := range strings.Split(*allowedSourcePaths0, ",") {
+		if strings.TrimSpace(sp) != "" {
+			allowedSourcePaths = append(allowedSourcePaths, filepath.Clean(strings.TrimSpace(sp)))
+		}
+	}
+	for _, ar := range strings.Split(*allowedTaskRepos0, ",") {
+		if strings.TrimSpace(ar) != "" {
+			allowedTaskRepos = append(allowedTaskRepos, strings.TrimSpace(ar))
+		}
+	}
 
-	c := conductor.NewConductorWorker(*conductorURL0, 1, 500, 5000)
+	vaultSecretsTTL = *vaultSecretsTTL0
+	vaultAddr1 := firstNonEmpty(*vaultAddr, os.Getenv("VAULT_ADDR"))
+	if vaultAddr1 != "" {
+		vc, err := NewVaultClient(vaultAddr1, firstNonEmpty(*vaultToken, os.Getenv("VAULT_TOKEN")), *vaultRoleID, *vaultSecretID, *vaultK8sRole, *vaultK8sTokenFile, *vaultAuthPath, firstNonEmpty(*vaultCACertFile, os.Getenv("VAULT_CACERT")))
+		if err != nil {
+			logrus.Errorf("Invalid Vault configuration. err=%s", err)
+			panic(1)
+		}
+		vaultClient = vc
+	}
 
-	c.Start("backup", backupTask, false)
-	c.Start("remove", removeTask, true)
-}
+	if *redisAddr != "" {
+		dl, err := NewRedisLocker(*redisAddr, firstNonEmpty(*redisPassword, os.Getenv("REDIS_PASSWORD")), *redisDB, time.Duration(*distLockTTLSeconds)*time.Second)
+		if err != nil {
+			logrus.Errorf("Invalid Redis configuration. err=%s", err)
+			panic(1)
+		}
+		distLocker = dl
+	}
 
-func backupTask(t *task.Task) (tr *task.TaskResult, err error) {
-	repoLock.Lock()
-	defer repoLock.Unlock()
-	logrus.Debugf("Executing backupTask")
+	configureRepository = func(r *Repository) error {
+		if r.PackSizeMB == 0 {
+			r.PackSizeMB = *packSizeMB
+		}
+		if r.PackSizeMB != 0 {
+			if r.PackSizeMB < 4 || r.PackSizeMB > 128 {
+				return fmt.Errorf("Invalid pack size %dMB of repository %s. It must be from 4 to 128", r.PackSizeMB, r.Name)
+			}
+			err := requireResticFeature("pack-size")
+			if err != nil {
+				return err
+			}
+		}
+		err := configureS3(r, *awsAccessKeyID, *awsSecretAccessKey, *awsRegion, *s3Endpoint, firstNonEmpty(*awsProfile, os.Getenv("AWS_PROFILE")))
+		if err != nil {
+			return fmt.Errorf("Invalid s3 configuration. err=%s", err)
+		}
 
-	bn, ok := t.InputData["backupName"]
-	if !ok {
-		return tr, fmt.Errorf("'backupName' is required as Input data")
+		err = configureS3Compat(r, *s3PathStyle, *s3Region, *s3CACertFile, *s3InsecureTLS)
+		if err != nil {
+			return fmt.Errorf("Invalid s3 configuration. err=%s", err)
+		}
+
+		err = configureB2(r, *b2AccountID, *b2AccountKey, *b2Connections)
+		if err != nil {
+			return fmt.Errorf("Invalid b2 configuration. err=%s", err)
+		}
+
+		err = configureAzure(r, *azureAccountName, *azureAccountKey, *azureAccountSAS)
+		if err != nil {
+			return fmt.Errorf("Invalid azure configuration. err=%s", err)
+		}
+
+		err = configureGCS(r, *gcsProjectID, *gcsCredentialsFile, *gcsCredentialsJSON)
+		if err != nil {
+			return fmt.Errorf("Invalid gs configuration. err=%s", err)
+		}
+
+		err = configureSFTP(r, *sftpKeyFile, *sftpPort, *sftpKnownHostsFile, *sftpAcceptNewHostKeys)
+		if err != nil {
+			return fmt.Errorf("Invalid sftp configuration. err=%s", err)
+		}
+
+		err = configureRest(r, *restUsername, *restPassword)
+		if err != nil {
+			return fmt.Errorf("Invalid rest configuration. err=%s", err)
+		}
+
+		err = configureTLS(r, *caCertFile, *tlsClientCertFile)
+		if err != nil {
+			return fmt.Errorf("Invalid tls configuration. err=%s", err)
+		}
+
+		err = configureRclone(r, *rcloneConfigFile)
+		if err != nil {
+			return fmt.Errorf("Invalid rclone configuration. err=%s", err)
+		}
+
+		err = configureSwift(r, *swiftAuthURL, *swiftRegion, *swiftUsername, *swiftPassword, *swiftTenant, *swiftDomain)
+		if err != nil {
+			return fmt.Errorf("Invalid swift configuration. err=%s", err)
+		}
+		return nil
+	}
+	for _, o := range resticOpts {
+		if !strings.Contains(o, "=") {
+			logrus.Errorf("Invalid '--restic-opt' %s. It must be in the form 'key=value'", o)
+			panic(1)
+		}
+	}
+	for _, o := range strings.Split(*allowedTaskResticOpts, ",") {
+		if strings.TrimSpace(o) != "" {
+			allowedTaskOptions = append(allowedTaskOptions, strings.TrimSpace(o))
+		}
+	}
+	for _, r := range allRepositories() {
+		r.options = append(r.options, resticOpts...)
+		if *secretsDir != "" {
+			r.secretsDir = filepath.Join(*secretsDir, r.Name)
+		}
+		r.watchSecrets()
+		err := configureRepository(r)
+		if err != nil {
+			logrus.Errorf("Invalid configuration for repository %s. %s", r.Name, err)
+			panic(1)
+		}
 	}
 
-	backupName := bn.(string)
-	logrus.Debugf("Creating backup. backupName=%s", backupName)
+	logrus.Info("====Starting Restic Conductor Worker====")
+	logrus.Infof("Using restic %s at %s", resticVersion, resticPath)
 
-	createTimeout := 1 * time.Minute
-	to, ok1 := t.InputData["timeoutSeconds"]
-	if ok1 {
-		timeout := to.(float64)
-		createTimeout = time.Duration(int(timeout)) * time.Second
+	conductorURL = *conductorURL0
+	if *statusAddr != "" {
+		startStatusServer(*statusAddr)
 	}
 
-	_, err2 := ExecShellf("restic -r %s unlock", repoDir)
-	if err2 != nil {
-		return nil, err2
+	orphans := 0
+	if *pidDir != "" {
+		orphans, err = stopOrphanedProcesses(*pidDir)
+		if err != nil {
+			logrus.Errorf("Couldn't stop orphaned restic processes. err=%s", err)
+			panic(1)
+		}
 	}
 
-	dataID, dataSizeMB, err := createNewBackup(backupName, createTimeout)
-	if err != nil {
-		return nil, err
+	for _, r := range allRepositories() {
+		err := initRepo(r)
+		if err != nil && noInit {
+			logrus.Errorf("%s", err)
+			panic(1)
+		}
+		if orphans > 0 {
+			//locks of the stopped processes are stale now
+			_, err := r.Restic(workerContext, "unlock")
+			if err != nil {
+				logrus.Warnf("Couldn't remove stale locks of repository %s. err=%s", r.Name, err)
+			}
+		}
 	}
 
-	tr = task.NewTaskResult(t)
-	output := map[string]interface{}{
-		"dataId":     dataID,
-		"dataSizeMB": dataSizeMB,
+	go stopOnSignal()
+	if maxCacheSizeMB > 0 {
+		go watchCacheSize()
 	}
-	tr.OutputData = output
-	tr.Status = task.COMPLETED
+	go reloadOnSignal(*configFile, setFlags)
 
-	return tr, nil
+	taskLogs = *taskLogs0
+	progressUpdateTime = time.Duration(*progressUpdateSeconds) * time.Second
+	c := conductor.NewConductorWorker(*conductorURL0, *taskThreads, 500, 5000)
+	conductorClient = c.ConductorHttpClient
+	taskStatusCheckTime = time.Duration(*taskStatusCheckSeconds) * time.Second
+
+	c.Start("backup", runTask(backupTask), false)
+	c.Start("remove", runTask(removeTask), false)
+	c.Start("restore", runTask(restoreTask), false)
+	c.Start("listBackups", runTask(listBackupsTask), false)
+	c.Start("check", runTask(checkTask), false)
+	c.Start("prune", runTask(pruneTask), false)
+	c.Start("repoStats", runTask(repoStatsTask), false)
+	c.Start("copy", runTask(copyTask), false)
+	c.Start("diff", runTask(diffTask), false)
+	c.Start("find", runTask(findTask), false)
+	c.Start("dump", runTask(dumpTask), false)
+	c.Start("tag", runTask(tagTask), false)
+	c.Start("applyRetention", runTask(applyRetentionTask), false)
+	c.Start("repairIndex", runTask(repairIndexTask), false)
+	c.Start("migrate", runTask(migrateTask), false)
+	c.Start("unlock", runTask(unlockTask), false)
+	c.Start("listRepoKeys", runTask(listRepoKeysTask), false)
+	c.Start("addRepoKey", runTask(addRepoKeyTask), false)
+	c.Start("removeRepoKey", runTask(removeRepoKeyTask), false)
+	c.Start("rotateRepoPassword", runTask(rotateRepoPasswordTask), false)
+	c.Start("cleanupCache", runTask(cleanupCacheTask), false)
+	c.Start("rewrite", runTask(rewriteTask), false)
+	c.Start("ls", runTask(lsTask), false)
+	c.Start("snapshotInfo", runTask(snapshotInfoTask), true)
 }
 
-func removeTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
-	repoLock.Lock()
-	defer repoLock.Unlock()
-	logrus.Debugf("Executing removeTask")
+// runTask wrap a task function reporting in the task output whether a failure was caused by a command timeout and its error code.
+// Failures that can't succeed when retried end the task with FAILED_WITH_TERMINAL_ERROR
+func runTask(fn func(t *task.Task) (*task.TaskResult, error)) func(t *task.Task) (*task.TaskResult, error) {
+	return func(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+		addMetric("backtor_tasks_polled_total", 1, "task", t.TaskType)
+		if !inShard(t) {
+			logrus.Debugf("Task %s of backupName %s belongs to another shard. Returning it to the queue", t.TaskId, taskBackupName(t))
+			addMetric("backtor_tasks_requeued_total", 1, "task", t.TaskType)
+			return requeueTask(t), nil
+		}
+		startTime := time.Now()
+		defer func() {
+			recordTask(t, tr0, err0, time.Since(startTime))
+		}()
+		//a panicking task must not stop the worker along with the other running tasks
+		defer func() {
+			r := recover()
+			if r != nil {
+				logrus.Errorf("Task %s %s panicked. err=%v\n%s", t.TaskType, t.TaskId, r, debug.Stack())
+				tr0 = task.NewTaskResult(t)
+				tr0.OutputData = map[string]interface{}{"errorCode": ErrorUnknown, "errorMessage": fmt.Sprintf("%v", r)}
+				err0 = fmt.Errorf("Task panicked. err=%v", r)
+			}
+		}()
+		ctx, cancel := context.WithCancel(workerContext)
+		defer cancel()
+		ctx, err := taskBandwidth(ctx, t)
+		if err != nil {
+			return terminalError(t, err)
+		}
+		ctx, err = taskResticOptions(ctx, t)
+		if err != nil {
+			return terminalError(t, err)
+		}
+		ctx, err = taskVerbosity(ctx, t)
+		if err != nil {
+			return terminalError(t, err)
+		}
+		ctx, err = taskCompression(ctx, t)
+		if err != nil {
+			return terminalError(t, err)
+		}
+		ctx, resticLog := withTaskLog(ctx)
+		taskContextsLock.Lock()
+		taskContexts[t.TaskId] = ctx
+		taskContextsLock.Unlock()
+		defer func() {
+			taskContextsLock.Lock()
+			delete(taskContexts, t.TaskId)
+			taskContextsLock.Unlock()
+		}()
+		go watchTaskStatus(ctx, cancel, t)
 
-	bn, ok := t.InputData["backupName"]
-	if !ok {
-		return tr0, fmt.Errorf("'backupName' is required as Input data")
+		tr, err := fn(t)
+		if tr == nil && err != nil {
+			tr = task.NewTaskResult(t)
+		}
+		if tr != nil && tr.OutputData == nil {
+			tr.OutputData = map[string]interface{}{}
+		}
+		if tr != nil && resticVerbosity(ctx) > 0 {
+			tr.OutputData["resticLog"] = redactSecrets(resticLog.String())
+		}
+		if taskLogs && len(resticLog.buf) > 0 {
+			err := postTaskLog(t.TaskId, redactSecrets(resticLog.String()))
+			if err != nil {
+				logrus.Warnf("Couldn't add restic output to the logs of task %s. err=%s", t.TaskId, err)
+			}
+		}
+		if err == nil {
+			return tr, nil
+		}
+		_, timedOut := err.(*CmdTimeoutError)
+		if timedOut {
+			logrus.Warnf("Task %s failed because restic timed out. err=%s", t.TaskType, err)
+		}
+		code, terminal := failureOutput(ctx, tr, err)
+		if terminal {
+			//Conductor marks tasks returned with an error as FAILED, so terminal failures are returned as results
+			logrus.Errorf("Task %s failed with terminal error %s. err=%s", t.TaskType, code, err)
+			tr.Status = "FAILED_WITH_TERMINAL_ERROR"
+			tr.ReasonForIncompletion = err.Error()
+			return tr, nil
+		}
+		return tr, err
 	}
-	backupName := bn.(string)
+}
 
-	di, ok := t.InputData["dataId"]
+// taskContext return the context of a running task, canceled when the task is canceled or timed out in Conductor or the worker stops
+func taskContext(t *task.Task) context.Context {
+	taskContextsLock.Lock()
+	defer taskContextsLock.Unlock()
+	ctx, ok := taskContexts[t.TaskId]
 	if !ok {
-		return tr0, fmt.Errorf("'backupName' is required as Input data")
+		return workerContext
 	}
-	dataID := di.(string)
-
-	logrus.Debugf("Deleting backup. backupName=%s dataID=%s", backupName, dataID)
+	return ctx
+}
 
-	_, err2 := ExecShellf("restic -r %s unlock", repoDir)
-	if err2 != nil {
-		return nil, err2
+// taskBandwidth return a ctx with the bandwidth limits of the 'limitUploadKB' and 'limitDownloadKB' inputs of a task, when set
+func taskBandwidth(ctx context.Context, t *task.Task) (context.Context, error) {
+	up, ok1, err := inputNumber(t, "limitUploadKB")
+	if err != nil {
+		return nil, err
 	}
-	err := deleteBackup(dataID)
+	down, ok2, err := inputNumber(t, "limitDownloadKB")
 	if err != nil {
 		return nil, err
 	}
-
-	tr := task.NewTaskResult(t)
-	output := map[string]interface{}{}
-	tr.OutputData = output
-	tr.Status = task.COMPLETED
-
-	return tr, nil
+	if !ok1 && !ok2 {
+		return ctx, nil
+	}
+	configLock.RLock()
+	limits := defaultBandwidth
+	configLock.RUnlock()
+	if ok1 {
+		limits.upload = int(up)
+	}
+	if ok2 {
+		limits.download = int(down)
+	}
+	logrus.Debugf("Task %s bandwidth limits upload=%dKiB/s download=%dKiB/s", t.TaskId, limits.upload, limits.download)
+	return withBandwidthLimits(ctx, limits.upload, limits.download), nil
 }
 
-func initRepo() error {
-	repoLock.Lock()
-	defer repoLock.Unlock()
-	logrus.Debugf("Checking if Restic repo %s was already initialized", repoDir)
-	result, err := ExecShellf("restic snapshots -r %s", repoDir)
-	if err != nil {
-		logrus.Debugf("Couldn't access Restic repo. Trying to create it. err=%s", err)
-		_, err := ExecShellf("restic init -r %s", repoDir)
-		if err != nil {
-			logrus.Debugf("Error creating Restic repo: %s %s", err, result)
-			return err
+// taskResticOptions return a ctx with the extended options of the 'resticOptions' input of a task ('key=value' list). Only keys in
+// allowedTaskOptions are accepted, as others (ex.: 'sftp.command') could run arbitrary commands
+func taskResticOptions(ctx context.Context, t *task.Task) (context.Context, error) {
+	options := inputStrings(t, "resticOptions")
+	if len(options) == 0 {
+		return ctx, nil
+	}
+	for _, o := range options {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid input data 'resticOptions' %s. Options must be in the form 'key=value'", o)
+		}
+		allowed := false
+		for _, a := range allowedTaskOptions {
+			if a == kv[0] {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("Invalid input data 'resticOptions'. Option %s is not allowed for tasks", kv[0])
 		}
-		logrus.Infof("Restic repo created successfuly")
-	} else {
-		logrus.Infof("Restic repo already exists and is accessible")
 	}
-	return nil
+	logrus.Debugf("Task %s restic options %v", t.TaskId, options)
+	return withResticOptions(ctx, options), nil
 }
 
-func createNewBackup(backupName string, createTimeout time.Duration) (dataID0 string, dataSizeMB0 int, err0 error) {
-	logrus.Infof("createNewBackup() backupName=%s", backupName)
-
-	sourceDir := fmt.Sprintf("/backup-source/%s", backupName)
-	_, err := os.Stat(sourceDir)
-	if os.IsNotExist(err) {
-		return "", -1, fmt.Errorf("Source backup dir %s doesn't exist", sourceDir)
+// taskVerbosity return a ctx with the restic verbosity of the 'resticVerbosity' input of a task, when set
+func taskVerbosity(ctx context.Context, t *task.Task) (context.Context, error) {
+	v, ok := t.InputData["resticVerbosity"]
+	if !ok {
+		return ctx, nil
 	}
-
-	logrus.Infof("Calling Restic...")
-	result, err := ExecShellfTimeout(createTimeout, "restic backup %s -r %s", sourceDir, repoDir)
+	verbosity, err := parseVerbosity(fmt.Sprintf("%v", v))
 	if err != nil {
-		return "", -1, err
-	}
-	logrus.Debugf("result: %s", result)
-	rex, _ := regexp.Compile("snapshot ([0-9a-zA-z]+) saved")
-	id := rex.FindStringSubmatch(result)
-	success := (len(id) == 2)
-	if !success {
-		logrus.Warnf("Snapshot not created. result=%s", result)
+		return nil, fmt.Errorf("Invalid input data 'resticVerbosity'. %s", err)
 	}
+	return withVerbosity(ctx, verbosity), nil
+}
 
-	dataID := id[1]
-	logrus.Infof("Backup finished")
+// taskCompression return a ctx with the compression of the 'compression' task input, if set
+func taskCompression(ctx context.Context, t *task.Task) (context.Context, error) {
+	c, ok := t.InputData["compression"]
+	if !ok {
+		return ctx, nil
+	}
+	compression, err := parseCompression(fmt.Sprintf("%v", c))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid input data 'compression'. %s", err)
+	}
+	return withCompression(ctx, compression), nil
+}
 
-	dataSizeMB := 111
+// watchTaskStatus cancel a running task when Conductor marks it as canceled, timed out or failed (ex.: its workflow was terminated)
+func watchTaskStatus(ctx context.Context, cancel context.CancelFunc, t *task.Task) {
+	if conductorClient == nil || taskStatusCheckTime <= 0 {
+		return
+	}
+	ticker := time.NewTicker(taskStatusCheckTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			resp, err := conductorClient.GetTask(t.TaskId)
+			if err != nil {
+				logrus.Debugf("Couldn't get status of task %s from Conductor. err=%s", t.TaskId, err)
+				continue
+			}
+			status := struct {
+				Status string `json:"status"`
+			}{}
+			err = json.Unmarshal([]byte(resp), &status)
+			if err != nil || status.Status == "" {
+				logrus.Debugf("Couldn't parse status of task %s. err=%v", t.TaskId, err)
+				continue
+			}
+			if status.Status != string(task.IN_PROGRESS) && status.Status != task.SCHEDULED {
+				logrus.Warnf("Task %s (%s) is %s in Conductor. Stopping it", t.TaskType, t.TaskId, status.Status)
+				cancel()
+				return
+			}
+		}
+	}
+}
 
-	return dataID, dataSizeMB, nil
+// setLogLevel set the log level to debug, info, warning or error
+func setLogLevel(level string) {
+	switch level {
+	case "debug":
+		logrus.SetLevel(logrus.DebugLevel)
+		break
+	case "warning":
+		logrus.SetLevel(logrus.WarnLevel)
+		break
+	case "error":
+		logrus.SetLevel(logrus.ErrorLevel)
+		break
+	default:
+		logrus.SetLevel(logrus.InfoLevel)
+	}
 }
 
-func deleteBackup(dataID string) error {
-	logrus.Debugf("deleteBackup dataID=%s", dataID)
+// stopOnSignal cancel running restic commands and exit on SIGTERM/SIGINT
+func stopOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	logrus.Infof("Received %s. Stopping running restic commands", sig)
+	stopWorker()
+	//give tasks some time to report their failure to Conductor
+	time.Sleep(5 * time.Second)
+	os.Exit(0)
+}
 
-	logrus.Debugf("Backup dataID=%s found. Proceeding to deletion", dataID)
-	result, err := ExecShellf("restic forget %s -r %s", dataID, repoDir)
-	if err != nil {
-		return err
+func backupTask(t *task.Task) (tr *task.TaskResult, err error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
 	}
-	logrus.Debugf("result: %s", result)
+	repo.lock.RLockName(taskBackupName(t), taskPriority(t))
+	defer repo.lock.RUnlockName(taskBackupName(t))
+	logrus.Debugf("Executing backupTask")
+	ctx := taskContext(t)
+	releaseLock, err1 := repo.distributedLock(ctx)
+	if err1 != nil {
+		return nil, err1
+	}
+	defer releaseLock()
 
-	rex, _ := regexp.Compile("removed snapshot ([0-9a-zA-z]+)")
-	id := rex.FindStringSubmatch(result)
-	if len(id) != 2 {
-		return fmt.Errorf("Couldn't find returned id from response")
+	backupName, ok, err1 := inputString(t, "backupName")
+	if err1 != nil {
+		return terminalError(t, err1)
 	}
-	if id[1] != dataID {
-		return fmt.Errorf("Returned id from forget is different from requested. %s != %s", id[1], dataID)
+	if !ok {
+		return tr, fmt.Errorf("'backupName' is required as Input data")
 	}
 
-	logrus.Debugf("Delete dataID %s successful", dataID)
-	return nil
+	logrus.Debugf("Creating backup. backupName=%s", backupName)
+
+	profile := backupProfile(backupName)
+	createTimeout := defaultBackupTimeout
+	if profile.TimeoutSeconds > 0 {
+		createTimeout = time.Duration(profile.TimeoutSeconds) * time.Second
+	}
+	createTimeout, err1 = taskTimeout(t, createTimeout)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	sourceDirs := backupSourceDirs(backupName)
+	inputPaths := inputStrings(t, "sourcePaths")
+	sp, ok := t.InputData["sourcePath"]
+	if ok {
+		inputPaths = append([]string{fmt.Sprintf("%v", sp)}, inputPaths...)
+	}
+	if len(inputPaths) > 0 {
+		sourceDirs = []string{}
+		for _, p := range inputPaths {
+			dir, err := allowedSourcePath(p)
+			if err != nil {
+				return terminalError(t, err)
+			}
+			sourceDirs = append(sourceDirs, dir)
+		}
+	}
+	args := []string{}
+	configLock.RLock()
+	excludes := append(append(append([]string{}, defaultExcludes...), profile.Excludes...), inputStrings(t, "excludes")...)
+	markers := append(append(append([]string{}, defaultExcludeIfPresent...), profile.ExcludeIfPresent...), inputStrings(t, "excludeIfPresent")...)
+	configLock.RUnlock()
+	for _, e := range excludes {
+		args = append(args, "--exclude", e)
+	}
+	for _, m := range markers {
+		args = append(args, "--exclude-if-present", m)
+	}
+	if ignoreFileName != "" {
+		excludeFile, err := backupIgnoreFile(sourceDirs)
+		if err != nil {
+			return nil, err
+		}
+		if excludeFile != "" {
+			defer os.Remove(excludeFile)
+			args = append(args, "--exclude-file", excludeFile)
+		}
+	}
+	tags := append(append(append([]string{}, defaultTags...), profile.Tags...), inputStrings(t, "tags")...)
+	for _, tag := range tags {
+		args = append(args, "--tag", tag)
+	}
+	host := firstNonEmpty(profile.Host, snapshotHost)
+	hs, ok, err1 := inputString(t, "host")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if ok {
+		host = hs
+	}
+	if host != "" {
+		args = append(args, "--host", host)
+	}
+	oneFS, err1 := backupFlag(t, "oneFileSystem", profile.OneFileSystem, oneFileSystem)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if oneFS {
+		args = append(args, "--one-file-system")
+	}
+	caches, err1 := backupFlag(t, "excludeCaches", profile.ExcludeCaches, excludeCaches)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if caches {
+		args = append(args, "--exclude-caches")
+	}
+	//unstable inodes or ctimes of network filesystems and overlayfs would make restic read all files again
+	inode, err1 := backupFlag(t, "ignoreInode", profile.IgnoreInode, ignoreInode)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if inode {
+		args = append(args, "--ignore-inode")
+	}
+	ctime, err1 := backupFlag(t, "ignoreCtime", profile.IgnoreCtime, ignoreCtime)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if ctime {
+		err1 = requireResticFeature("ignore-ctime")
+		if err1 != nil {
+			return terminalError(t, err1)
+		}
+		args = append(args, "--ignore-ctime")
+	}
+	maxSize := firstNonEmpty(profile.ExcludeLargerThan, excludeLargerThan)
+	ms, ok := t.InputData["excludeLargerThan"]
+	if ok {
+		maxSize = fmt.Sprintf("%v", ms)
+	}
+	if maxSize != "" {
+		err1 = checkSize(maxSize)
+		if err1 != nil {
+			return terminalError(t, fmt.Errorf("Invalid input data 'excludeLargerThan'. %s", err1))
+		}
+		args = append(args, "--exclude-larger-than", maxSize)
+	}
+	dryRun, err1 := backupFlag(t, "dryRun", nil, false)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if dryRun {
+		err1 = requireResticFeature("dry-run")
+		if err1 != nil {
+			return terminalError(t, err1)
+		}
+		args = append(args, "--dry-run")
+	}
+	filesFrom, err1 := backupFilesFrom(t, sourceDirs)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if filesFrom != "" {
+		defer os.Remove(filesFrom)
+		args = append(args, "--files-from", filesFrom)
+	} else {
+		args = append(args, sourceDirs...)
+	}
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, createTimeout)
+	defer cancel()
+	lastUpdate := time.Now()
+	onProgress := func(m ResticMessage) {
+		if progressUpdateTime <= 0 || time.Since(lastUpdate) < progressUpdateTime {
+			return
+		}
+		lastUpdate = time.Now()
+		progress := map[string]interface{}{
+			"percentDone": m.PercentDone * 100,
+			"filesDone":   m.FilesDone,
+			"totalFiles":  m.TotalFiles,
+			"bytesDone":   m.BytesDone,
+			"totalBytes":  m.TotalBytes,
+			"etaSeconds":  m.SecondsRemaining,
+		}
+		//the backup is stopped at its timeout, so Conductor must not give it to another worker before that
+		deadline, _ := ctx.Deadline()
+		err := updateTaskProgress(t, progress, time.Until(deadline)+time.Minute)
+		if err != nil {
+			logrus.Debugf("Couldn't update progress of task %s. err=%s", t.TaskId, err)
+		}
+	}
+	summary, err := createNewBackup(ctx, repo, backupName, sourceDirs, args, dryRun, onProgress)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		tr = task.NewTaskResult(t)
+		tr.OutputData = map[string]interface{}{
+			"dryRun":          true,
+			"dataSizeMB":      float64(summary.TotalBytesProcessed) / 1024 / 1024,
+			"dataAddedMB":     float64(summary.DataAdded) / 1024 / 1024,
+			"files":           summary.TotalFilesProcessed,
+			"filesNew":        summary.FilesNew,
+			"filesChanged":    summary.FilesChanged,
+			"filesUnmodified": summary.FilesUnmodified,
+			"dirsNew":         summary.DirsNew,
+			"dirsChanged":     summary.DirsChanged,
+			"dirsUnmodified":  summary.DirsUnmodified,
+			"paths":           sourceDirs,
+		}
+		tr.Status = task.COMPLETED
+		return tr, nil
+	}
+	snapshot, err := findSnapshot(ctx, repo, summary.SnapshotID)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.Parent == "" {
+		logrus.Infof("Backup %s had no parent snapshot and scanned all files", snapshot.ShortID)
+	}
+	repoSizeMB := -1.0
+	repoSize, err := repoRawSize(ctx, repo, summary.DataAdded)
+	if err != nil {
+		logrus.Warnf("Couldn't get size of repository %s. err=%s", repo.Name, err)
+		repoSize = -1
+	} else {
+		repoSizeMB = float64(repoSize) / 1024 / 1024
+	}
+	recordBackup(backupName, repo, summary, repoSize)
+
+	tr = task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"dataId":          snapshot.ShortID,
+		"dataIdFull":      snapshot.ID,
+		"dataSizeMB":      float64(summary.TotalBytesProcessed) / 1024 / 1024,
+		"dataAddedMB":     float64(summary.DataAdded) / 1024 / 1024,
+		"files":           summary.TotalFilesProcessed,
+		"filesNew":        summary.FilesNew,
+		"filesChanged":    summary.FilesChanged,
+		"filesUnmodified": summary.FilesUnmodified,
+		"dirsNew":         summary.DirsNew,
+		"dirsChanged":     summary.DirsChanged,
+		"dirsUnmodified":  summary.DirsUnmodified,
+		"time":            snapshot.Time,
+		"hostname":        snapshot.Hostname,
+		"paths":           snapshot.Paths,
+		"parent":          snapshot.Parent,
+		"full":            snapshot.Parent == "",
+		"repoTotalSizeMB": repoSizeMB,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func removeTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.Lock(taskPriority(t))
+	defer repo.lock.Unlock()
+	logrus.Debugf("Executing removeTask")
+	ctx := taskContext(t)
+	releaseLock, err1 := repo.distributedLock(ctx)
+	if err1 != nil {
+		return nil, err1
+	}
+	defer releaseLock()
+
+	repo, err1 = repo.deletingRepository("remove")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	backupName, ok, err1 := inputString(t, "backupName")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if !ok {
+		return tr0, fmt.Errorf("'backupName' is required as Input data")
+	}
+
+	dataIDs := inputStrings(t, "dataIds")
+	di, ok, err1 := inputString(t, "dataId")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if ok {
+		dataIDs = append(dataIDs, di)
+	}
+	tags := inputStrings(t, "tags")
+	if len(dataIDs) == 0 && len(tags) == 0 {
+		return tr0, fmt.Errorf("'dataId', 'dataIds' or 'tags' is required as Input data")
+	}
+
+	logrus.Debugf("Deleting backup. backupName=%s dataIDs=%v tags=%v", backupName, dataIDs, tags)
+
+	removeTimeout, err1 := taskTimeout(t, defaultRemoveTimeout)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+	ctx, cancel := context.WithTimeout(ctx, removeTimeout)
+	defer cancel()
+	if len(tags) > 0 {
+		//the snapshots of backupName with all tags, or the given ones among them
+		snapshots, err := listSnapshots(ctx, repo, backupFilters(backupName, tags)...)
+		if err != nil {
+			return nil, err
+		}
+		tagged := []string{}
+		for _, s := range snapshots {
+			if len(dataIDs) == 0 || hasDataID(dataIDs, s) {
+				tagged = append(tagged, s.ShortID)
+			}
+		}
+		dataIDs = tagged
+	}
+	if len(dataIDs) > 0 {
+		err := deleteBackups(ctx, repo, dataIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"removedDataIds": dataIDs,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func restoreTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.RLock(taskPriority(t))
+	defer repo.lock.RUnlock()
+	logrus.Debugf("Executing restoreTask")
+	ctx := taskContext(t)
+
+	dataID, ok, err1 := inputString(t, "dataId")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if !ok {
+		return tr0, fmt.Errorf("'dataId' is required as Input data")
+	}
+
+	targetPath, ok, err1 := inputString(t, "targetPath")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if !ok {
+		return tr0, fmt.Errorf("'targetPath' is required as Input data")
+	}
+
+	restoreTimeout, err1 := taskTimeout(t, defaultTaskTimeout)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	logrus.Debugf("Restoring backup. dataID=%s targetPath=%s", dataID, targetPath)
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	restoredFiles, restoredBytes, err := restoreBackup(ctx, repo, dataID, targetPath, restoreTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"restoredFiles": restoredFiles,
+		"restoredBytes": restoredBytes,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func listBackupsTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.RLock(taskPriority(t))
+	defer repo.lock.RUnlock()
+	logrus.Debugf("Executing listBackupsTask")
+	ctx := taskContext(t)
+
+	backupName, _, err1 := inputString(t, "backupName")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	tags := inputStrings(t, "tags")
+	tg, ok, err1 := inputString(t, "tag")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if ok {
+		tags = append(tags, tg)
+	}
+
+	logrus.Debugf("Listing backups. backupName=%s tags=%v", backupName, tags)
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	backups, err := listBackups(ctx, repo, backupName, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"backups": backups,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func checkTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.RLock(taskPriority(t))
+	defer repo.lock.RUnlock()
+	logrus.Debugf("Executing checkTask")
+	ctx := taskContext(t)
+
+	readDataSubset, _, err1 := inputString(t, "readDataSubset")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	checkTimeout, err1 := taskTimeout(t, defaultTaskTimeout)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	hasErrors, packsChecked, errorSummaries, err := checkRepo(ctx, repo, readDataSubset, checkTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"hasErrors":    hasErrors,
+		"packsChecked": packsChecked,
+		"errors":       errorSummaries,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func pruneTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.Lock(taskPriority(t))
+	defer repo.lock.Unlock()
+	logrus.Debugf("Executing pruneTask")
+	ctx := taskContext(t)
+	releaseLock, err1 := repo.distributedLock(ctx)
+	if err1 != nil {
+		return nil, err1
+	}
+	defer releaseLock()
+
+	repo, err1 = repo.deletingRepository("prune")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	pruneTimeout, err1 := taskTimeout(t, defaultTaskTimeout)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	freedMB, duration, err := pruneRepo(ctx, repo, pruneTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"freedMB":         freedMB,
+		"durationSeconds": duration.Seconds(),
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func repoStatsTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.RLock(taskPriority(t))
+	defer repo.lock.RUnlock()
+	logrus.Debugf("Executing repoStatsTask")
+	ctx := taskContext(t)
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	output, err := repoStats(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func copyTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.RLockName(taskBackupName(t), taskPriority(t))
+	defer repo.lock.RUnlockName(taskBackupName(t))
+	logrus.Debugf("Executing copyTask")
+	ctx := taskContext(t)
+
+	dataID, _, err1 := inputString(t, "dataId")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	tag, _, err1 := inputString(t, "tag")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if dataID == "" && tag == "" {
+		return tr0, fmt.Errorf("'dataId' or 'tag' is required as Input data")
+	}
+
+	err1 = requireResticFeature("copy")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	_, ok := t.InputData["targetPassword"]
+	if ok {
+		return terminalError(t, fmt.Errorf("Invalid input data 'targetPassword'. Use 'targetPasswordRef'"))
+	}
+	target, err1 := copyTarget(t, repo)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	copyTimeout, err1 := taskTimeout(t, defaultTaskTimeout)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	logrus.Debugf("Copying backup. dataID=%s tag=%s targetRepo=%s", dataID, tag, target.Name)
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	newDataIDs, err := copyBackup(ctx, repo, dataID, tag, target, copyTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"dataIds": newDataIDs,
+	}
+	if len(newDataIDs) > 0 {
+		output["dataId"] = newDataIDs[0]
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func diffTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.RLock(taskPriority(t))
+	defer repo.lock.RUnlock()
+	logrus.Debugf("Executing diffTask")
+	ctx := taskContext(t)
+
+	dataIDA, ok, err1 := inputString(t, "dataIdA")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if !ok {
+		return tr0, fmt.Errorf("'dataIdA' is required as Input data")
+	}
+
+	dataIDB, ok, err1 := inputString(t, "dataIdB")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if !ok {
+		return tr0, fmt.Errorf("'dataIdB' is required as Input data")
+	}
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	output, err := diffBackups(ctx, repo, dataIDA, dataIDB)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func findTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.RLock(taskPriority(t))
+	defer repo.lock.RUnlock()
+	logrus.Debugf("Executing findTask")
+	ctx := taskContext(t)
+
+	pattern, ok, err1 := inputString(t, "pattern")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if !ok {
+		return tr0, fmt.Errorf("'pattern' is required as Input data")
+	}
+
+	dataID, _, err1 := inputString(t, "dataId")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	matches, err := findFiles(ctx, repo, pattern, dataID)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"matches": matches,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func dumpTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.RLock(taskPriority(t))
+	defer repo.lock.RUnlock()
+	logrus.Debugf("Executing dumpTask")
+	ctx := taskContext(t)
+
+	dataID, ok, err1 := inputString(t, "dataId")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if !ok {
+		return tr0, fmt.Errorf("'dataId' is required as Input data")
+	}
+
+	filePath, ok, err1 := inputString(t, "path")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if !ok {
+		return tr0, fmt.Errorf("'path' is required as Input data")
+	}
+
+	outputPath, _, err1 := inputString(t, "outputPath")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	dumpTimeout, err1 := taskTimeout(t, defaultTaskTimeout)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	output, err := dumpFile(ctx, repo, dataID, filePath, outputPath, dumpTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func tagTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.Lock(taskPriority(t))
+	defer repo.lock.Unlock()
+	logrus.Debugf("Executing tagTask")
+	ctx := taskContext(t)
+	releaseLock, err1 := repo.distributedLock(ctx)
+	if err1 != nil {
+		return nil, err1
+	}
+	defer releaseLock()
+
+	repo, err1 = repo.deletingRepository("tag")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	dataID, ok, err1 := inputString(t, "dataId")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if !ok {
+		return tr0, fmt.Errorf("'dataId' is required as Input data")
+	}
+
+	addTags := inputStrings(t, "addTags")
+	removeTags := inputStrings(t, "removeTags")
+	setTags := inputStrings(t, "setTags")
+	if len(addTags) == 0 && len(removeTags) == 0 && len(setTags) == 0 {
+		return tr0, fmt.Errorf("'addTags', 'removeTags' or 'setTags' is required as Input data")
+	}
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	newDataID, tags, err := tagBackup(ctx, repo, dataID, addTags, removeTags, setTags)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"dataId": newDataID,
+		"tags":   tags,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func applyRetentionTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.Lock(taskPriority(t))
+	defer repo.lock.Unlock()
+	logrus.Debugf("Executing applyRetentionTask")
+	ctx := taskContext(t)
+	releaseLock, err1 := repo.distributedLock(ctx)
+	if err1 != nil {
+		return nil, err1
+	}
+	defer releaseLock()
+
+	repo, err1 = repo.deletingRepository("applyRetention")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	policy := []string{}
+	for _, k := range []string{"keepLast", "keepHourly", "keepDaily", "keepWeekly", "keepMonthly", "keepYearly"} {
+		v, ok, err := inputNumber(t, k)
+		if err != nil {
+			return terminalError(t, err)
+		}
+		if ok {
+			flagName := strings.ToLower(strings.Replace(k, "keep", "keep-", 1))
+			policy = append(policy, "--"+flagName, strconv.Itoa(int(v)))
+		}
+	}
+	keepWithin, ok, err1 := inputString(t, "keepWithin")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if ok {
+		policy = append(policy, "--keep-within", keepWithin)
+	}
+	backupName := taskBackupName(t)
+	filters := backupFilters(backupName, nil)
+	if len(policy) == 0 && backupName != "" && backupProfile(backupName).Retention != nil {
+		policy = backupProfile(backupName).Retention.policy()
+	}
+	if len(policy) == 0 {
+		return tr0, fmt.Errorf("At least one of 'keepLast', 'keepHourly', 'keepDaily', 'keepWeekly', 'keepMonthly', 'keepYearly' or 'keepWithin' is required as Input data")
+	}
+
+	for _, tag := range inputStrings(t, "tags") {
+		filters = append(filters, "--tag", tag)
+	}
+	host, ok, err1 := inputString(t, "host")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if ok {
+		filters = append(filters, "--host", host)
+	}
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	kept, removed, err := applyRetention(ctx, repo, policy, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"keptDataIds":    kept,
+		"removedDataIds": removed,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func repairIndexTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.Lock(taskPriority(t))
+	defer repo.lock.Unlock()
+	logrus.Debugf("Executing repairIndexTask")
+	ctx := taskContext(t)
+	releaseLock, err1 := repo.distributedLock(ctx)
+	if err1 != nil {
+		return nil, err1
+	}
+	defer releaseLock()
+
+	repo, err1 = repo.deletingRepository("repairIndex")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	repairTimeout, err1 := taskTimeout(t, defaultTaskTimeout)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	command, result, duration, err := repairIndex(ctx, repo, repairTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"command":         command,
+		"result":          result,
+		"durationSeconds": duration.Seconds(),
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func migrateTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.Lock(taskPriority(t))
+	defer repo.lock.Unlock()
+	logrus.Debugf("Executing migrateTask")
+	ctx := taskContext(t)
+	releaseLock, err1 := repo.distributedLock(ctx)
+	if err1 != nil {
+		return nil, err1
+	}
+	defer releaseLock()
+
+	repo, err1 = repo.deletingRepository("migrate")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	migration, _, err1 := inputString(t, "migration")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	repack, _, err1 := inputBool(t, "repackUncompressed")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	migrateTimeout, err1 := taskTimeout(t, defaultTaskTimeout)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	output, err := migrateRepo(ctx, repo, migration, migrateTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if repack && migration != "" {
+		//compress the data written before the upgrade to repository format version 2
+		logrus.Infof("Repacking uncompressed data of repository %s", repo.Name)
+		_, err = repo.ResticTimeout(ctx, migrateTimeout, "prune", "--repack-uncompressed")
+		if err != nil {
+			return nil, err
+		}
+		output["repackedUncompressed"] = true
+	}
+
+	tr := task.NewTaskResult(t)
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func unlockTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.Lock(taskPriority(t))
+	defer repo.lock.Unlock()
+	logrus.Debugf("Executing unlockTask")
+	ctx := taskContext(t)
+	releaseLock, err1 := repo.distributedLock(ctx)
+	if err1 != nil {
+		return nil, err1
+	}
+	defer releaseLock()
+
+	removeAll, _, err1 := inputBool(t, "removeAll")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	removedLocks, err := unlockRepo(ctx, repo, removeAll)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"removedLocks": removedLocks,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func listRepoKeysTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.RLock(taskPriority(t))
+	defer repo.lock.RUnlock()
+	logrus.Debugf("Executing listRepoKeysTask")
+	ctx := taskContext(t)
+
+	keys, err := listRepoKeys(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"keys": keys,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func addRepoKeyTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.Lock(taskPriority(t))
+	defer repo.lock.Unlock()
+	logrus.Debugf("Executing addRepoKeyTask")
+	ctx := taskContext(t)
+	releaseLock, err1 := repo.distributedLock(ctx)
+	if err1 != nil {
+		return nil, err1
+	}
+	defer releaseLock()
+
+	newPassword, ok, err1 := inputString(t, "newPassword")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if !ok {
+		return tr0, fmt.Errorf("'newPassword' is required as Input data")
+	}
+
+	keyID, err := addRepoKey(ctx, repo, newPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"keyId": keyID,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func removeRepoKeyTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.Lock(taskPriority(t))
+	defer repo.lock.Unlock()
+	logrus.Debugf("Executing removeRepoKeyTask")
+	ctx := taskContext(t)
+	releaseLock, err1 := repo.distributedLock(ctx)
+	if err1 != nil {
+		return nil, err1
+	}
+	defer releaseLock()
+
+	repo, err1 = repo.deletingRepository("removeRepoKey")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	keyID, ok, err1 := inputString(t, "keyId")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if !ok {
+		return tr0, fmt.Errorf("'keyId' is required as Input data")
+	}
+
+	err := removeRepoKey(ctx, repo, keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func rotateRepoPasswordTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.Lock(taskPriority(t))
+	defer repo.lock.Unlock()
+	logrus.Debugf("Executing rotateRepoPasswordTask")
+	ctx := taskContext(t)
+	releaseLock, err1 := repo.distributedLock(ctx)
+	if err1 != nil {
+		return nil, err1
+	}
+	defer releaseLock()
+
+	if repo.AppendOnly {
+		return terminalError(t, fmt.Errorf("Repository %s is append-only and rotateRepoPassword would remove its current key. Use addRepoKey, or rotate the password of its 'deleteRepository'", repo.Name))
+	}
+	source := repo.passwordSource()
+	if source != "" {
+		return terminalError(t, fmt.Errorf("Repository %s reads its password from %s, which would still have the old password after the rotation. Use addRepoKey, update the %s and then removeRepoKey", repo.Name, source, source))
+	}
+
+	newPassword, ok, err1 := inputString(t, "newPassword")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if !ok {
+		return tr0, fmt.Errorf("'newPassword' is required as Input data")
+	}
+
+	oldKeyID, newKeyID, err := rotateRepoPassword(ctx, repo, newPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"oldKeyId": oldKeyID,
+		"newKeyId": newKeyID,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func cleanupCacheTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	//the caches of all repositories are cleaned up, each while its repository is locked
+	logrus.Debugf("Executing cleanupCacheTask")
+	ctx := taskContext(t)
+
+	maxSizeMB := maxCacheSizeMB
+	ms, ok, err1 := inputNumber(t, "maxCacheSizeMB")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if ok {
+		maxSizeMB = int(ms)
+	}
+
+	freedBytes, cacheSizeBytes, err := cleanupCache(ctx, maxSizeMB)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"freedBytes":     freedBytes,
+		"cacheSizeBytes": cacheSizeBytes,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func rewriteTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.Lock(taskPriority(t))
+	defer repo.lock.Unlock()
+	logrus.Debugf("Executing rewriteTask")
+	ctx := taskContext(t)
+	releaseLock, err1 := repo.distributedLock(ctx)
+	if err1 != nil {
+		return nil, err1
+	}
+	defer releaseLock()
+
+	err1 = requireResticFeature("rewrite")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	excludes := inputStrings(t, "excludes")
+	if len(excludes) == 0 {
+		return tr0, fmt.Errorf("'excludes' is required as Input data")
+	}
+
+	dataIDs := inputStrings(t, "dataIds")
+
+	forget, _, err1 := inputBool(t, "forget")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if forget {
+		repo, err1 = repo.deletingRepository("rewrite with 'forget'")
+		if err1 != nil {
+			return terminalError(t, err1)
+		}
+	}
+
+	rewriteTimeout, err1 := taskTimeout(t, defaultTaskTimeout)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	rewritten, err := rewriteBackups(ctx, repo, excludes, dataIDs, forget, rewriteTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"rewritten": rewritten,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func lsTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.RLock(taskPriority(t))
+	defer repo.lock.RUnlock()
+	logrus.Debugf("Executing lsTask")
+	ctx := taskContext(t)
+
+	dataID, ok, err1 := inputString(t, "dataId")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if !ok {
+		return tr0, fmt.Errorf("'dataId' is required as Input data")
+	}
+
+	pathPrefix, _, err1 := inputString(t, "path")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	offset := 0
+	of, ok, err1 := inputNumber(t, "offset")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if ok {
+		offset = int(of)
+	}
+
+	limit := 1000
+	lm, ok, err1 := inputNumber(t, "limit")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if ok {
+		limit = int(lm)
+	}
+
+	lsTimeout, err1 := taskTimeout(t, defaultTaskTimeout)
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	files, total, err := listFiles(ctx, repo, dataID, pathPrefix, offset, limit, lsTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	output := map[string]interface{}{
+		"files":  files,
+		"total":  total,
+		"offset": offset,
+		"limit":  limit,
+	}
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+func snapshotInfoTask(t *task.Task) (tr0 *task.TaskResult, err0 error) {
+	repo, err1 := taskRepository(t)
+	if err1 != nil {
+		return nil, err1
+	}
+	repo.lock.RLock(taskPriority(t))
+	defer repo.lock.RUnlock()
+	logrus.Debugf("Executing snapshotInfoTask")
+	ctx := taskContext(t)
+
+	dataID, ok, err1 := inputString(t, "dataId")
+	if err1 != nil {
+		return terminalError(t, err1)
+	}
+	if !ok {
+		return tr0, fmt.Errorf("'dataId' is required as Input data")
+	}
+
+	err2 := removeStaleLocks(ctx, repo)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	output, err := snapshotInfo(ctx, repo, dataID)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := task.NewTaskResult(t)
+	tr.OutputData = output
+	tr.Status = task.COMPLETED
+
+	return tr, nil
+}
+
+// taskPriority return the priority configured for the task type. Waiting tasks with higher priority get the repository first
+func taskPriority(t *task.Task) int {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return taskPriorities[t.TaskType]
+}
+
+// taskBackupName return the 'backupName' input of a task, or empty if it has none
+func taskBackupName(t *task.Task) string {
+	bn, ok := t.InputData["backupName"]
+	if !ok {
+		return ""
+	}
+	backupName, _ := bn.(string)
+	return backupName
+}
+
+// terminalError fail a task with FAILED_WITH_TERMINAL_ERROR so that Conductor doesn't retry it
+func terminalError(t *task.Task, err error) (*task.TaskResult, error) {
+	logrus.Errorf("Task %s failed with terminal error. err=%s", t.TaskType, err)
+	tr := task.NewTaskResult(t)
+	tr.Status = "FAILED_WITH_TERMINAL_ERROR"
+	tr.ReasonForIncompletion = err.Error()
+	tr.OutputData = map[string]interface{}{}
+	failureOutput(taskContext(t), tr, err)
+	return tr, nil
+}
+
+// failureOutput add the error details of a failed task to its output: errorCode, errorMessage, timedOut and the exit code and last
+// output lines of restic (of the failed command, or of the task log when err isn't a restic failure). Returns the error code and
+// whether it is terminal
+func failureOutput(ctx context.Context, tr *task.TaskResult, err error) (string, bool) {
+	_, timedOut := err.(*CmdTimeoutError)
+	tr.OutputData["timedOut"] = timedOut
+	code, terminal := classifyError(err)
+	tr.OutputData["errorCode"] = code
+	tr.OutputData["errorMessage"] = redactSecrets(err.Error())
+	tr.OutputData["resticExitCode"] = -1
+	output := ""
+	log, ok := ctx.Value(taskLogKey{}).(*tailBuffer)
+	if ok {
+		output = log.String()
+	}
+	cmdErr, ok := err.(*CmdError)
+	if ok {
+		tr.OutputData["resticExitCode"] = cmdErr.ExitCode
+		output = cmdErr.Output
+	}
+	tr.OutputData["resticOutput"] = lastLines(redactSecrets(output), failureOutputLines)
+	return code, terminal
+}
+
+// taskTimeout return the 'timeout' or 'timeoutSeconds' task input, in seconds or as a duration (ex.: '45m'), or def when the task has none
+func taskTimeout(t *task.Task, def time.Duration) (time.Duration, error) {
+	for _, name := range []string{"timeout", "timeoutSeconds"} {
+		v, ok := t.InputData[name]
+		if !ok {
+			continue
+		}
+		timeout, err := parseTimeout(v)
+		if err != nil || timeout <= 0 {
+			return 0, fmt.Errorf("Invalid input data '%s'. Use seconds or a duration (ex.: '45m')", name)
+		}
+		return timeout, nil
+	}
+	return def, nil
+}
+
+// parseTimeout parse a number of seconds or a duration string
+func parseTimeout(v interface{}) (time.Duration, error) {
+	switch vv := v.(type) {
+	case float64:
+		return time.Duration(vv * float64(time.Second)), nil
+	case string:
+		seconds, err := strconv.ParseFloat(vv, 64)
+		if err == nil {
+			return time.Duration(seconds * float64(time.Second)), nil
+		}
+		return time.ParseDuration(vv)
+	}
+	return 0, fmt.Errorf("Invalid timeout %v", v)
+}
+
+// inputString return the string task input name and whether the task has it
+func inputString(t *task.Task, name string) (string, bool, error) {
+	v, ok := t.InputData[name]
+	if !ok {
+		return "", false, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", true, fmt.Errorf("Invalid input data '%s'. Expected a string", name)
+	}
+	return s, true, nil
+}
+
+// inputNumber return the numeric task input name and whether the task has it
+func inputNumber(t *task.Task, name string) (float64, bool, error) {
+	v, ok := t.InputData[name]
+	if !ok {
+		return 0, false, nil
+	}
+	n, ok := v.(float64)
+	if !ok {
+		return 0, true, fmt.Errorf("Invalid input data '%s'. Expected a number", name)
+	}
+	return n, true, nil
+}
+
+// inputBool return the boolean task input name and whether the task has it
+func inputBool(t *task.Task, name string) (bool, bool, error) {
+	v, ok := t.InputData[name]
+	if !ok {
+		return false, false, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, true, fmt.Errorf("Invalid input data '%s'. Expected true or false", name)
+	}
+	return b, true, nil
+}
+
+// inputStrings read a task input that may be either a list of strings or a comma separated string
+func inputStrings(t *task.Task, name string) []string {
+	values := make([]string, 0)
+	v, ok := t.InputData[name]
+	if !ok {
+		return values
+	}
+	switch vv := v.(type) {
+	case string:
+		for _, s := range strings.Split(vv, ",") {
+			if strings.TrimSpace(s) != "" {
+				values = append(values, strings.TrimSpace(s))
+			}
+		}
+	case []interface{}:
+		for _, s := range vv {
+			values = append(values, fmt.Sprintf("%v", s))
+		}
+	}
+	return values
+}
+
+func initRepo(repo *Repository) error {
+	repo.lock.Lock(0)
+	defer repo.lock.Unlock()
+	logrus.Debugf("Checking if Restic repo %s was already initialized", repo.Name)
+	result, err := repo.Restic(workerContext, "snapshots")
+	if err != nil && noInit {
+		return fmt.Errorf("Couldn't access Restic repo %s and automatic creation is disabled. Check its location and password. err=%s", repo.Name, err)
+	}
+	if err != nil {
+		logrus.Debugf("Couldn't access Restic repo. Trying to create it. err=%s", err)
+		_, err := repo.Restic(workerContext, "init")
+		if err != nil {
+			logrus.Debugf("Error creating Restic repo: %s %s", err, result)
+			return err
+		}
+		logrus.Infof("Restic repo created successfuly")
+	} else {
+		logrus.Infof("Restic repo already exists and is accessible")
+	}
+	return nil
+}
+
+// createNewBackup back up sourceDirs in a single snapshot. args are the restic backup flags followed by the paths to back up. With dryRun,
+// args must have '--dry-run' and the summary of what would be backed up is returned without creating a snapshot
+func createNewBackup(ctx context.Context, repo *Repository, backupName string, sourceDirs []string, args []string, dryRun bool, onProgress func(ResticMessage)) (*BackupSummary, error) {
+	logrus.Infof("createNewBackup() backupName=%s sourceDirs=%v args=%v", backupName, sourceDirs, args)
+
+	for _, sourceDir := range sourceDirs {
+		_, err := os.Stat(sourceDir)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("Source backup dir %s doesn't exist", sourceDir)
+		}
+	}
+
+	logrus.Infof("Calling Restic...")
+	var summary *BackupSummary
+	lastProgress := time.Now()
+	result, err := retryRestic(ctx, func() (string, error) {
+		summary = nil
+		return repo.ResticStream(ctx, func(line string) {
+			message := jsonMessage(line)
+			switch message.MessageType {
+			case "status":
+				if time.Since(lastProgress) >= backupProgressInterval {
+					lastProgress = time.Now()
+					logrus.Infof("Backup progress %.1f%%. files=%d/%d bytes=%d/%d", message.PercentDone*100, message.FilesDone, message.TotalFiles, message.BytesDone, message.TotalBytes)
+				}
+				if onProgress != nil {
+					onProgress(message)
+				}
+			case "summary":
+				s := BackupSummary{}
+				err := json.Unmarshal([]byte(line), &s)
+				if err != nil {
+					logrus.Warnf("Couldn't parse backup summary. err=%s", err)
+					return
+				}
+				summary = &s
+			case "":
+				if strings.TrimSpace(line) != "" {
+					logrus.Debugf("restic: %s", line)
+				}
+			}
+		}, append([]string{"backup", "--json"}, args...)...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("result: %s", result)
+
+	if summary == nil {
+		return nil, fmt.Errorf("Couldn't find backup summary in restic output. result=%s", result)
+	}
+	if dryRun {
+		logrus.Infof("Dry run of backup %s finished. files=%d bytes=%d dataAdded=%d", backupName, summary.TotalFilesProcessed, summary.TotalBytesProcessed, summary.DataAdded)
+		return summary, nil
+	}
+	if summary.SnapshotID == "" {
+		return nil, fmt.Errorf("Snapshot not created. result=%s", result)
+	}
+
+	if summary.TotalBytesProcessed == 0 && summary.TotalFilesProcessed > 0 {
+		//summaries of some restic versions don't have the processed size
+		stats, err := resticStats(ctx, repo, summary.SnapshotID, "restore-size")
+		if err != nil {
+			return nil, err
+		}
+		summary.TotalBytesProcessed = stats.TotalSize
+	}
+
+	logrus.Infof("Backup finished. dataID=%s files=%d bytes=%d", summary.SnapshotID, summary.TotalFilesProcessed, summary.TotalBytesProcessed)
+	return summary, nil
+}
+
+func deleteBackups(ctx context.Context, repo *Repository, dataIDs []string) error {
+	logrus.Debugf("deleteBackups dataIDs=%v", dataIDs)
+
+	logrus.Debugf("Backup dataIDs=%v found. Proceeding to deletion", dataIDs)
+	result, err := repo.ResticContext(ctx, append([]string{"forget", "--json"}, dataIDs...)...)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("result: %s", result)
+
+	//forget reports nothing for explicit ids in json mode on most versions, so check the snapshots are gone
+	snapshots, err := listSnapshots(ctx, repo)
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots {
+		for _, dataID := range dataIDs {
+			if strings.HasPrefix(s.ID, dataID) {
+				return fmt.Errorf("Snapshot %s still exists after forget", dataID)
+			}
+		}
+	}
+
+	logrus.Debugf("Delete dataIDs %v successful", dataIDs)
+	return nil
+}
+
+func restoreBackup(ctx context.Context, repo *Repository, dataID string, targetPath string, restoreTimeout time.Duration) (restoredFiles0 int, restoredBytes0 int64, err0 error) {
+	logrus.Infof("restoreBackup() dataID=%s targetPath=%s", dataID, targetPath)
+
+	err := os.MkdirAll(targetPath, 0755)
+	if err != nil {
+		return -1, -1, fmt.Errorf("Couldn't create restore target dir %s. err=%s", targetPath, err)
+	}
+
+	logrus.Infof("Calling Restic...")
+	result, err := repo.ResticTimeout(ctx, restoreTimeout, "restore", dataID, "--target", targetPath)
+	if err != nil {
+		return -1, -1, err
+	}
+	logrus.Debugf("result: %s", result)
+
+	restoredFiles, restoredBytes, err := dirStats(targetPath)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	logrus.Infof("Restore finished. files=%d bytes=%d", restoredFiles, restoredBytes)
+	return restoredFiles, restoredBytes, nil
+}
+
+// Snapshot restic snapshot as returned by 'restic snapshots --json'
+type Snapshot struct {
+	ID       string    `json:"id"`
+	ShortID  string    `json:"short_id"`
+	Time     time.Time `json:"time"`
+	Parent   string    `json:"parent"`
+	Tree     string    `json:"tree"`
+	Paths    []string  `json:"paths"`
+	Hostname string    `json:"hostname"`
+	Tags     []string  `json:"tags"`
+	Original string    `json:"original"`
+	// Summary of the backup that created the snapshot. Only in snapshots of restic >= 0.17
+	Summary *struct {
+		TotalBytesProcessed int64 `json:"total_bytes_processed"`
+	} `json:"summary"`
+}
+
+// BackupSummary summary message of 'restic backup --json'
+type BackupSummary struct {
+	FilesNew            int     `json:"files_new"`
+	FilesChanged        int     `json:"files_changed"`
+	FilesUnmodified     int     `json:"files_unmodified"`
+	DirsNew             int     `json:"dirs_new"`
+	DirsChanged         int     `json:"dirs_changed"`
+	DirsUnmodified      int     `json:"dirs_unmodified"`
+	DataBlobs           int     `json:"data_blobs"`
+	TreeBlobs           int     `json:"tree_blobs"`
+	DataAdded           int64   `json:"data_added"`
+	TotalFilesProcessed int     `json:"total_files_processed"`
+	TotalBytesProcessed int64   `json:"total_bytes_processed"`
+	TotalDuration       float64 `json:"total_duration"`
+	SnapshotID          string  `json:"snapshot_id"`
+}
+
+// CheckSummary summary message of 'restic check --json'
+type CheckSummary struct {
+	NumErrors          int      `json:"num_errors"`
+	BrokenPacks        []string `json:"broken_packs"`
+	SuggestRepairIndex bool     `json:"suggest_repair_index"`
+	SuggestPrune       bool     `json:"suggest_prune"`
+}
+
+// ResticMessage common fields of the line delimited messages of restic --json outputs. Progress fields are set in 'status' messages
+type ResticMessage struct {
+	MessageType      string  `json:"message_type"`
+	PercentDone      float64 `json:"percent_done"`
+	TotalFiles       int     `json:"total_files"`
+	FilesDone        int     `json:"files_done"`
+	TotalBytes       int64   `json:"total_bytes"`
+	BytesDone        int64   `json:"bytes_done"`
+	SecondsRemaining int64   `json:"seconds_remaining"`
+}
+
+// backupProgressInterval interval between backup progress logs
+var backupProgressInterval = 30 * time.Second
+
+// jsonMessage decode a line of a restic --json output. MessageType is empty for lines that are not json messages
+func jsonMessage(line string) ResticMessage {
+	m := ResticMessage{}
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "{") {
+		json.Unmarshal([]byte(line), &m)
+	}
+	return m
+}
+
+// jsonMessages return the lines of a restic --json output whose message_type is messageType, ignoring lines that are not json
+func jsonMessages(result string, messageType string) []json.RawMessage {
+	messages := make([]json.RawMessage, 0)
+	for _, line := range strings.Split(result, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		m := struct {
+			MessageType string `json:"message_type"`
+		}{}
+		err := json.Unmarshal([]byte(line), &m)
+		if err != nil || m.MessageType != messageType {
+			continue
+		}
+		messages = append(messages, json.RawMessage(line))
+	}
+	return messages
+}
+
+// BackupInfo snapshot summary returned in task outputs
+type BackupInfo struct {
+	DataID string    `json:"dataId"`
+	Time   time.Time `json:"time"`
+	Paths  []string  `json:"paths"`
+	Tags   []string  `json:"tags"`
+	SizeMB float64   `json:"sizeMB"`
+}
+
+// listSnapshots run 'restic snapshots' with optional filter args and parse its results
+func listSnapshots(ctx context.Context, repo *Repository, args ...string) ([]Snapshot, error) {
+	result, err := repo.ResticJSON(ctx, 90*time.Second, append([]string{"snapshots", "--json"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]Snapshot, 0)
+	err = json.Unmarshal([]byte(result), &snapshots)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse snapshots list. err=%s result=%s", err, result)
+	}
+	return snapshots, nil
+}
+
+// findSnapshot return the snapshot with id dataID (short or full)
+func findSnapshot(ctx context.Context, repo *Repository, dataID string) (Snapshot, error) {
+	snapshots, err := listSnapshots(ctx, repo, dataID)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if len(snapshots) != 1 {
+		return Snapshot{}, fmt.Errorf("Snapshot %s not found", dataID)
+	}
+	return snapshots[0], nil
+}
+
+// backupSourceDirs return the dirs backed up for backupName, which are also the snapshot paths of its backups
+func backupSourceDirs(backupName string) []string {
+	profile := backupProfile(backupName)
+	if len(profile.SourcePaths) > 0 {
+		return profile.SourcePaths
+	}
+	if profile.SourcePath != "" {
+		return []string{profile.SourcePath}
+	}
+	dir := strings.NewReplacer("{sourcePath}", sourcePath, "{backupName}", backupName).Replace(sourceDirTemplate)
+	return []string{filepath.Clean(dir)}
+}
+
+var sizeRegex = regexp.MustCompile("^[0-9]+[bBkKmMgGtT]?$")
+
+// checkSize validate a restic size (ex.: '500M', '2G') and that restic supports '--exclude-larger-than'
+func checkSize(size string) error {
+	if !sizeRegex.MatchString(size) {
+		return fmt.Errorf("Invalid size %s. Use a number of bytes with an optional K, M, G or T suffix", size)
+	}
+	return requireResticFeature("exclude-larger-than")
+}
+
+// backupFlag return the bool task input, or the profile value if the task doesn't have it, or def if neither is set
+func backupFlag(t *task.Task, input string, profile *bool, def bool) (bool, error) {
+	b, ok, err := inputBool(t, input)
+	if err != nil || ok {
+		return b, err
+	}
+	if profile != nil {
+		return *profile, nil
+	}
+	return def, nil
+}
+
+// hasDataID whether one of dataIDs (short or full) is the id of the snapshot
+func hasDataID(dataIDs []string, s Snapshot) bool {
+	for _, id := range dataIDs {
+		if id != "" && strings.HasPrefix(s.ID, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// backupFilters return the restic snapshot filters of the snapshots of backupName (all if empty) that have all tags
+func backupFilters(backupName string, tags []string) []string {
+	filters := []string{}
+	if backupName != "" {
+		//restic only matches snapshots with all paths
+		for _, dir := range backupSourceDirs(backupName) {
+			filters = append(filters, "--path", dir)
+		}
+	}
+	if len(tags) > 0 {
+		filters = append(filters, "--tag", strings.Join(tags, ","))
+	}
+	return filters
+}
+
+// allowedSourcePath return the real path of a 'sourcePath' input if it is inside one of the allowed source paths
+func allowedSourcePath(sourcePath string) (string, error) {
+	if !filepath.IsAbs(sourcePath) {
+		return "", fmt.Errorf("Invalid input data 'sourcePath' %s. It must be an absolute path", sourcePath)
+	}
+	//symlinks could point outside of the allowed dirs
+	realPath, err := filepath.EvalSymlinks(filepath.Clean(sourcePath))
+	if err != nil {
+		return "", fmt.Errorf("Invalid input data 'sourcePath' %s. err=%s", sourcePath, err)
+	}
+	for _, base := range allowedSourcePaths {
+		realBase, err := filepath.EvalSymlinks(base)
+		if err != nil {
+			continue
+		}
+		if insideDir(realBase, realPath) {
+			return realPath, nil
+		}
+	}
+	return "", fmt.Errorf("Invalid input data 'sourcePath' %s. It is not inside the '--allowed-source-paths' %v", sourcePath, allowedSourcePaths)
+}
+
+// insideDir whether path is dir or one of its descendants
+func insideDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// backupFilesFrom write the 'files' input and the entries of the 'filesFrom' input file to a restic '--files-from' file. Relative
+// entries are relative to the source dir and all must be inside it. Returns empty if the task has neither input
+func backupFilesFrom(t *task.Task, sourceDirs []string) (string, error) {
+	files := inputStrings(t, "files")
+	ff, ok := t.InputData["filesFrom"]
+	if len(files) == 0 && !ok {
+		return "", nil
+	}
+	if len(sourceDirs) != 1 {
+		return "", fmt.Errorf("Invalid input data 'files'. Backups of several source paths can't select files")
+	}
+	sourceDir := sourceDirs[0]
+	if ok {
+		file := fmt.Sprintf("%v", ff)
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(sourceDir, file)
+		}
+		allowed := insideDir(sourceDir, filepath.Clean(file))
+		for _, base := range allowedSourcePaths {
+			allowed = allowed || insideDir(base, filepath.Clean(file))
+		}
+		if !allowed {
+			return "", fmt.Errorf("Invalid input data 'filesFrom' %s. It must be inside the source dir or '--allowed-source-paths'", ff)
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("Invalid input data 'filesFrom'. err=%s", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				files = append(files, line)
+			}
+		}
+	}
+	if len(files) == 0 {
+		if ok {
+			return "", fmt.Errorf("Invalid input data 'filesFrom' %s. It has no files", ff)
+		}
+		return "", nil
+	}
+
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(sourceDir, f)
+		}
+		f = filepath.Clean(f)
+		if !insideDir(sourceDir, f) {
+			return "", fmt.Errorf("Invalid input data 'files'. %s is not inside the source dir %s", f, sourceDir)
+		}
+		paths = append(paths, f)
+	}
+	tmp, err := ioutil.TempFile("", "backtor-files-")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	_, err = tmp.WriteString(strings.Join(paths, "\n") + "\n")
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	logrus.Debugf("Backing up %d files of %s", len(paths), sourceDir)
+	return tmp.Name(), nil
+}
+
+// backupIgnoreFile write a restic '--exclude-file' with the patterns of the ignore files found in sourceDirs. Patterns apply to the dir of
+// their ignore file: the ones starting with '/' to its entries and the others to entries of any depth. Returns empty if there are no patterns
+func backupIgnoreFile(sourceDirs []string) (string, error) {
+	patterns := []string{}
+	for _, sourceDir := range sourceDirs {
+		err := filepath.Walk(sourceDir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				//unreadable dirs are reported by restic
+				return nil
+			}
+			if info.IsDir() || info.Name() != ignoreFileName {
+				return nil
+			}
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				logrus.Warnf("Couldn't read ignore file %s. err=%s", p, err)
+				return nil
+			}
+			dir := filepath.Dir(p)
+			for _, line := range strings.Split(string(data), "\n") {
+				pattern := strings.TrimSpace(line)
+				if pattern == "" || strings.HasPrefix(pattern, "#") {
+					continue
+				}
+				negate := strings.HasPrefix(pattern, "!")
+				pattern = strings.TrimPrefix(pattern, "!")
+				if strings.HasPrefix(pattern, "/") {
+					pattern = filepath.Join(dir, pattern)
+				} else {
+					pattern = filepath.Join(dir, "**", pattern)
+				}
+				if negate {
+					pattern = "!" + pattern
+				}
+				patterns = append(patterns, pattern)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("Couldn't look up ignore files in %s. err=%s", sourceDir, err)
+		}
+	}
+	if len(patterns) == 0 {
+		return "", nil
+	}
+	tmp, err := ioutil.TempFile("", "backtor-excludes-")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	_, err = tmp.WriteString(strings.Join(patterns, "\n") + "\n")
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	logrus.Debugf("Found %d exclude patterns in %s files", len(patterns), ignoreFileName)
+	return tmp.Name(), nil
+}
+
+// listBackups list the snapshots of backupName (all if empty) that have all tags
+func listBackups(ctx context.Context, repo *Repository, backupName string, tags []string) ([]BackupInfo, error) {
+	logrus.Debugf("listBackups() backupName=%s tags=%v", backupName, tags)
+
+	filters := backupFilters(backupName, tags)
+
+	snapshots, err := listSnapshots(ctx, repo, filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]BackupInfo, 0)
+	for _, s := range snapshots {
+		backups = append(backups, BackupInfo{
+			DataID: s.ShortID,
+			Time:   s.Time,
+			Paths:  s.Paths,
+			Tags:   s.Tags,
+			SizeMB: snapshotSizeMB(s),
+		})
+	}
+
+	logrus.Debugf("Found %d backups", len(backups))
+	return backups, nil
+}
+
+// snapshotSizeMB restore size of a snapshot from its summary, so listing snapshots doesn't run 'restic stats' for each of them.
+// -1 for snapshots without summary
+func snapshotSizeMB(s Snapshot) float64 {
+	if s.Summary == nil {
+		return -1
+	}
+	return float64(s.Summary.TotalBytesProcessed) / 1024 / 1024
+}
+
+// Stats restic stats as returned by 'restic stats --json'
+type Stats struct {
+	TotalSize      int64 `json:"total_size"`
+	TotalFileCount int64 `json:"total_file_count"`
+	TotalBlobCount int64 `json:"total_blob_count"`
+}
+
+func resticStats(ctx context.Context, repo *Repository, dataID string, mode string) (Stats, error) {
+	stats := Stats{}
+	args := []string{"stats", "--mode", mode, "--json"}
+	if dataID != "" {
+		args = append(args, dataID)
+	}
+	result, err := repo.ResticJSON(ctx, 90*time.Second, args...)
+	if err != nil {
+		return stats, err
+	}
+	err = json.Unmarshal([]byte(result), &stats)
+	if err != nil {
+		return stats, fmt.Errorf("Couldn't parse stats. err=%s result=%s", err, result)
+	}
+	return stats, nil
+}
+
+// repoSizeRefreshTime how long the raw size of a repository is estimated by adding the data of new backups before it is computed again
+var repoSizeRefreshTime = 1 * time.Hour
+
+// repoRawSize return the raw size of the repository data after a backup that added bytes. The size computed by 'restic stats' is cached
+// and new backups are added to it until it is older than repoSizeRefreshTime, as stats reads the whole index. Must be called with the repo lock held
+func repoRawSize(ctx context.Context, repo *Repository, added int64) (int64, error) {
+	repo.rawSizeLock.Lock()
+	defer repo.rawSizeLock.Unlock()
+	if !repo.rawSizeTime.IsZero() && time.Since(repo.rawSizeTime) < repoSizeRefreshTime {
+		repo.rawSize = repo.rawSize + added
+		return repo.rawSize, nil
+	}
+	stats, err := resticStats(ctx, repo, "", "raw-data")
+	if err != nil {
+		return -1, err
+	}
+	repo.rawSize = stats.TotalSize
+	repo.rawSizeTime = time.Now()
+	return repo.rawSize, nil
+}
+
+func repoStats(ctx context.Context, repo *Repository) (map[string]interface{}, error) {
+	logrus.Infof("repoStats()")
+
+	rawStats, err := resticStats(ctx, repo, "", "raw-data")
+	if err != nil {
+		return nil, err
+	}
+	restoreStats, err := resticStats(ctx, repo, "", "restore-size")
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := listSnapshots(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotSizes := make([]map[string]interface{}, 0)
+	for _, s := range snapshots {
+		snapshotSizes = append(snapshotSizes, map[string]interface{}{
+			"dataId":        s.ShortID,
+			"restoreSizeMB": snapshotSizeMB(s),
+		})
+	}
+
+	return map[string]interface{}{
+		"totalSizeMB":        float64(rawStats.TotalSize) / 1024 / 1024,
+		"totalRestoreSizeMB": float64(restoreStats.TotalSize) / 1024 / 1024,
+		"totalFileCount":     restoreStats.TotalFileCount,
+		"totalBlobCount":     rawStats.TotalBlobCount,
+		"snapshots":          snapshotSizes,
+	}, nil
+}
+
+func checkRepo(ctx context.Context, repo *Repository, readDataSubset string, checkTimeout time.Duration) (hasErrors0 bool, packsChecked0 int, errors0 []string, err0 error) {
+	logrus.Infof("checkRepo() readDataSubset=%s", readDataSubset)
+
+	packs, err := repo.Restic(ctx, "list", "packs")
+	if err != nil {
+		return false, -1, nil, err
+	}
+	packsChecked := subsetPacks(strings.Fields(packs), readDataSubset)
+
+	args := []string{"check", "--json"}
+	if readDataSubset != "" {
+		args = append(args, fmt.Sprintf("--read-data-subset=%s", readDataSubset))
+	}
+
+	logrus.Infof("Calling Restic...")
+	result, err := repo.ResticJSON(ctx, checkTimeout, args...)
+	logrus.Debugf("result: %s", result)
+
+	errorSummaries := make([]string, 0)
+	for _, m := range jsonMessages(result, "error") {
+		e := struct {
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(m, &e) == nil && e.Message != "" {
+			errorSummaries = append(errorSummaries, e.Message)
+		}
+	}
+	summary := CheckSummary{}
+	messages := jsonMessages(result, "summary")
+	if len(messages) > 0 {
+		json.Unmarshal(messages[len(messages)-1], &summary)
+	}
+	//restic versions without json check output print human text
+	failure := ""
+	if err != nil {
+		failure = err.Error()
+	}
+	if len(messages) == 0 && len(errorSummaries) == 0 && strings.Contains(failure, "repository contains errors") {
+		//check errors are printed to stderr, which is in the error
+		for _, line := range strings.Split(result+"\n"+failure, "\n") {
+			l := strings.ToLower(line)
+			if (strings.Contains(l, "error") || strings.Contains(l, "fatal")) && !strings.Contains(l, "repository contains errors") {
+				errorSummaries = append(errorSummaries, strings.TrimSpace(line))
+			}
+		}
+		if len(errorSummaries) == 0 {
+			errorSummaries = append(errorSummaries, "repository contains errors")
+		}
+	}
+	if summary.NumErrors > 0 || len(errorSummaries) > 0 {
+		logrus.Warnf("Repository check found errors. errors=%v", errorSummaries)
+		return true, packsChecked, errorSummaries, nil
+	}
+	if err != nil {
+		return false, -1, nil, err
+	}
+
+	logrus.Infof("Repository check finished with no errors. packs=%d", packsChecked)
+	return false, packsChecked, errorSummaries, nil
+}
+
+// subsetPacks count the packs whose data restic check reads with readDataSubset, selected the way restic does.
+// Returns -1 for size subsets (ex.: '50M'), whose packs are randomly chosen by their sizes
+func subsetPacks(packs []string, readDataSubset string) int {
+	if readDataSubset == "" {
+		return len(packs)
+	}
+	if strings.HasSuffix(readDataSubset, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(readDataSubset, "%"), 64)
+		if err != nil {
+			return -1
+		}
+		n := int(float64(len(packs)) * p / 100)
+		if len(packs) > 0 && n < 1 {
+			n = 1
+		}
+		return n
+	}
+	parts := strings.Split(readDataSubset, "/")
+	if len(parts) != 2 {
+		return -1
+	}
+	bucket, err1 := strconv.Atoi(parts[0])
+	buckets, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || bucket < 1 || buckets < bucket {
+		return -1
+	}
+	n := 0
+	for _, pack := range packs {
+		if len(pack) < 2 {
+			continue
+		}
+		b, err := strconv.ParseUint(pack[:2], 16, 8)
+		if err == nil && int(b)%buckets == bucket-1 {
+			n++
+		}
+	}
+	return n
+}
+
+func pruneRepo(ctx context.Context, repo *Repository, pruneTimeout time.Duration) (freedMB0 float64, duration0 time.Duration, err0 error) {
+	logrus.Infof("pruneRepo()")
+
+	local := isLocalRepo(repo.Repo)
+	sizeBefore := int64(0)
+	if local {
+		_, size, err := dirStats(repo.Repo)
+		if err != nil {
+			return -1, -1, err
+		}
+		sizeBefore = size
+	}
+
+	logrus.Infof("Calling Restic...")
+	startTime := time.Now()
+	result, err := repo.ResticTimeout(ctx, pruneTimeout, "prune")
+	if err != nil {
+		return -1, -1, err
+	}
+	duration := time.Since(startTime)
+	logrus.Debugf("result: %s", result)
+
+	freedMB := 0.0
+	if local {
+		_, sizeAfter, err := dirStats(repo.Repo)
+		if err != nil {
+			return -1, -1, err
+		}
+		freedMB = float64(sizeBefore-sizeAfter) / 1024 / 1024
+	} else {
+		//remote repositories can't be measured directly, so rely on what restic reports
+		freedMB, err = prunedMB(result)
+		if err != nil {
+			return -1, -1, err
+		}
+	}
+
+	logrus.Infof("Prune finished. freedMB=%.2f duration=%s", freedMB, duration)
+	return freedMB, duration, nil
+}
+
+// prunedMB size removed from the repository according to the prune output: its 'total prune' summary line (restic >= 0.12)
+// or the 'frees' line of older versions. 0 when there is none
+func prunedMB(result string) (float64, error) {
+	for _, expr := range []string{`total prune:\s+[0-9]+ blobs / ([0-9.]+ [a-zA-Z]+)`, "frees ([0-9.]+ [a-zA-Z]+)"} {
+		freed := regexp.MustCompile(expr).FindStringSubmatch(result)
+		if len(freed) == 2 {
+			return parseSizeMB(freed[1])
+		}
+	}
+	return 0, nil
+}
+
+// copyTarget return the repository copy tasks write to: the configured or allowed repository of the 'targetRepo' input, with the
+// password of 'targetPasswordRef', or '--copy-repo-dir'
+func copyTarget(t *task.Task, repo *Repository) (*Repository, error) {
+	targetRepo, ok, err := inputString(t, "targetRepo")
+	if err != nil {
+		return nil, err
+	}
+	passwordRef, _, err := inputString(t, "targetPasswordRef")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return overrideRepository(targetRepo, passwordRef)
+	}
+	if copyRepoDir == "" {
+		return nil, fmt.Errorf("'targetRepo' is required as Input data when '--copy-repo-dir' is not set")
+	}
+	password := copyResticPassword
+	if password == "" {
+		password, err = repo.password()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewRepository("copy-target", copyRepoDir, password), nil
+}
+
+func copyBackup(ctx context.Context, repo *Repository, dataID string, tag string, target *Repository, copyTimeout time.Duration) ([]string, error) {
+	logrus.Infof("copyBackup() dataID=%s tag=%s targetRepo=%s", dataID, tag, target.Name)
+
+	targetRepo := target.Repo
+	_, err := target.Restic(ctx, "snapshots")
+	if err != nil && noInit {
+		return nil, fmt.Errorf("Couldn't access target Restic repo %s and automatic creation is disabled. err=%s", targetRepo, err)
+	}
+	if err != nil {
+		logrus.Debugf("Couldn't access target Restic repo. Trying to create it. err=%s", err)
+		_, err := target.Restic(ctx, "init")
+		if err != nil {
+			return nil, err
+		}
+		logrus.Infof("Target Restic repo %s created successfuly", targetRepo)
+	}
+
+	//options of the source repository are global, so they are passed along with the target ones
+	args := []string{"copy"}
+	if repo.repoURL == "" {
+		args = append(args, "--from-repo", repo.Repo)
+	}
+	args = append(args, repo.flags...)
+	for _, o := range repo.options {
+		args = append(args, "-o", o)
+	}
+	if tag != "" {
+		args = append(args, "--tag", tag)
+	}
+	if dataID != "" {
+		args = append(args, dataID)
+	}
+
+	logrus.Infof("Calling Restic...")
+	fromPassword, err := repo.password()
+	if err != nil {
+		return nil, err
+	}
+	env, err := target.env()
+	if err != nil {
+		return nil, err
+	}
+	env = append(env, fmt.Sprintf("RESTIC_FROM_PASSWORD=%s", fromPassword))
+	if repo.repoURL != "" {
+		env = append(env, fmt.Sprintf("RESTIC_FROM_REPOSITORY=%s", repo.repoURL))
+	}
+	copyCtx, cancel := context.WithTimeout(ctx, copyTimeout)
+	defer cancel()
+	result, err := resticRunner.Run(copyCtx, env, nil, append(target.withArgs(args), contextArgs(copyCtx)...))
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("result: %s", result)
+
+	rex, _ := regexp.Compile("snapshot ([0-9a-zA-Z]+) saved")
+	ids := rex.FindAllStringSubmatch(result, -1)
+	newDataIDs := make([]string, 0)
+	for _, id := range ids {
+		newDataIDs = append(newDataIDs, id[1])
+	}
+	if len(newDataIDs) == 0 {
+		logrus.Warnf("No snapshots were copied. result=%s", result)
+	}
+
+	logrus.Infof("Copy finished. dataIds=%v", newDataIDs)
+	return newDataIDs, nil
+}
+
+func diffBackups(ctx context.Context, repo *Repository, dataIDA string, dataIDB string) (map[string]interface{}, error) {
+	logrus.Infof("diffBackups() dataIDA=%s dataIDB=%s", dataIDA, dataIDB)
+
+	result, err := repo.Restic(ctx, "diff", dataIDA, dataIDB)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("result: %s", result)
+
+	rex, _ := regexp.Compile("Files:\\s+([0-9]+) new,\\s+([0-9]+) removed,\\s+([0-9]+) changed")
+	files := rex.FindStringSubmatch(result)
+	if len(files) != 4 {
+		return nil, fmt.Errorf("Couldn't find file counts in diff response")
+	}
+	addedFiles, _ := strconv.Atoi(files[1])
+	removedFiles, _ := strconv.Atoi(files[2])
+	modifiedFiles, _ := strconv.Atoi(files[3])
+
+	addedMB := 0.0
+	rex, _ = regexp.Compile("Added:\\s+([0-9.]+ [a-zA-Z]+)")
+	added := rex.FindStringSubmatch(result)
+	if len(added) == 2 {
+		addedMB, err = parseSizeMB(added[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	removedMB := 0.0
+	rex, _ = regexp.Compile("Removed:\\s+([0-9.]+ [a-zA-Z]+)")
+	removed := rex.FindStringSubmatch(result)
+	if len(removed) == 2 {
+		removedMB, err = parseSizeMB(removed[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logrus.Debugf("Diff finished. added=%d removed=%d modified=%d", addedFiles, removedFiles, modifiedFiles)
+	return map[string]interface{}{
+		"addedFiles":    addedFiles,
+		"removedFiles":  removedFiles,
+		"modifiedFiles": modifiedFiles,
+		"addedMB":       addedMB,
+		"removedMB":     removedMB,
+		"deltaMB":       addedMB - removedMB,
+	}, nil
+}
+
+// FileMatch file path found by 'restic find' along with the snapshots containing it
+type FileMatch struct {
+	Path    string   `json:"path"`
+	DataIDs []string `json:"dataIds"`
+}
+
+func findFiles(ctx context.Context, repo *Repository, pattern string, dataID string) ([]FileMatch, error) {
+	logrus.Infof("findFiles() pattern=%s dataID=%s", pattern, dataID)
+
+	args := []string{"find", "--json"}
+	if dataID != "" {
+		args = append(args, "--snapshot", dataID)
+	}
+	args = append(args, pattern)
+
+	result, err := repo.ResticJSON(ctx, 90*time.Second, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]struct {
+		Snapshot string `json:"snapshot"`
+		Matches  []struct {
+			Path string `json:"path"`
+		} `json:"matches"`
+	}, 0)
+	err = json.Unmarshal([]byte(result), &found)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse find results. err=%s result=%s", err, result)
+	}
+
+	matches := make([]FileMatch, 0)
+	index := make(map[string]int)
+	for _, f := range found {
+		for _, m := range f.Matches {
+			i, ok := index[m.Path]
+			if !ok {
+				i = len(matches)
+				index[m.Path] = i
+				matches = append(matches, FileMatch{Path: m.Path, DataIDs: make([]string, 0)})
+			}
+			matches[i].DataIDs = append(matches[i].DataIDs, f.Snapshot)
+		}
+	}
+
+	logrus.Debugf("Found %d matching paths", len(matches))
+	return matches, nil
+}
+
+// max size of dumped files returned inline in task output when no output path is requested
+const maxInlineDumpBytes = 1024 * 1024
+
+func dumpFile(ctx context.Context, repo *Repository, dataID string, filePath string, outputPath string, dumpTimeout time.Duration) (map[string]interface{}, error) {
+	logrus.Infof("dumpFile() dataID=%s path=%s outputPath=%s", dataID, filePath, outputPath)
+
+	inline := (outputPath == "")
+	if inline {
+		f, err := ioutil.TempFile("", "restic-dump")
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't create temp file for dump. err=%s", err)
+		}
+		f.Close()
+		outputPath = f.Name()
+		defer os.Remove(outputPath)
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create dump output file %s. err=%s", outputPath, err)
+	}
+	_, err = repo.ResticStdout(ctx, dumpTimeout, out, "dump", dataID, filePath)
+	out.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't stat dumped file %s. err=%s", outputPath, err)
+	}
+
+	output := map[string]interface{}{
+		"sizeBytes": info.Size(),
+	}
+
+	if !inline {
+		output["outputPath"] = outputPath
+		logrus.Infof("Dump finished. outputPath=%s size=%d", outputPath, info.Size())
+		return output, nil
+	}
+
+	if info.Size() > maxInlineDumpBytes {
+		return nil, fmt.Errorf("File %s is too large to be returned inline (%d bytes). Use 'outputPath' instead", filePath, info.Size())
+	}
+	content, err := ioutil.ReadFile(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read dumped file. err=%s", err)
+	}
+	output["contentBase64"] = base64.StdEncoding.EncodeToString(content)
+
+	logrus.Infof("Dump finished. size=%d", info.Size())
+	return output, nil
+}
+
+func tagBackup(ctx context.Context, repo *Repository, dataID string, addTags []string, removeTags []string, setTags []string) (dataID0 string, tags0 []string, err0 error) {
+	logrus.Infof("tagBackup() dataID=%s add=%v remove=%v set=%v", dataID, addTags, removeTags, setTags)
+
+	args := []string{"tag"}
+	if len(setTags) > 0 {
+		args = append(args, "--set", strings.Join(setTags, ","))
+	}
+	if len(addTags) > 0 {
+		args = append(args, "--add", strings.Join(addTags, ","))
+	}
+	if len(removeTags) > 0 {
+		args = append(args, "--remove", strings.Join(removeTags, ","))
+	}
+	args = append(args, dataID)
+
+	before, err := listSnapshots(ctx, repo)
+	if err != nil {
+		return "", nil, err
+	}
+	var snapshot *Snapshot
+	existing := map[string]bool{}
+	for i, s := range before {
+		existing[s.ID] = true
+		if strings.HasPrefix(s.ID, dataID) {
+			snapshot = &before[i]
+		}
+	}
+	if snapshot == nil {
+		return "", nil, fmt.Errorf("Couldn't find snapshot %s", dataID)
+	}
+
+	result, err := repo.Restic(ctx, args...)
+	if err != nil {
+		return "", nil, err
+	}
+	logrus.Debugf("result: %s", result)
+
+	//restic replaces the snapshot by a new one when its tags change. Its 'original' keeps pointing to the first snapshot of a retagged
+	//one, so the new snapshot is the one that didn't exist before with the same tree and time
+	after, err := listSnapshots(ctx, repo)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, s := range after {
+		if s.ID == snapshot.ID {
+			logrus.Debugf("Tags of dataID %s unchanged. tags=%v", dataID, s.Tags)
+			return s.ShortID, s.Tags, nil
+		}
+	}
+	for _, s := range after {
+		if !existing[s.ID] && s.Tree == snapshot.Tree && s.Time.Equal(snapshot.Time) {
+			logrus.Debugf("Tags of dataID %s updated. newDataID=%s tags=%v", dataID, s.ShortID, s.Tags)
+			return s.ShortID, s.Tags, nil
+		}
+	}
+
+	return "", nil, fmt.Errorf("Couldn't find the new snapshot of %s after updating its tags", dataID)
+}
+
+func applyRetention(ctx context.Context, repo *Repository, policy []string, filters []string) (kept0 []string, removed0 []string, err0 error) {
+	logrus.Infof("applyRetention() policy=%v filters=%v", policy, filters)
+
+	args := append([]string{"forget", "--json"}, policy...)
+	result, err := repo.ResticJSON(ctx, 90*time.Second, append(args, filters...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	groups := make([]struct {
+		Keep   []Snapshot `json:"keep"`
+		Remove []Snapshot `json:"remove"`
+	}, 0)
+	err = json.Unmarshal([]byte(result), &groups)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Couldn't parse forget results. err=%s result=%s", err, result)
+	}
+
+	kept := make([]string, 0)
+	removed := make([]string, 0)
+	for _, g := range groups {
+		for _, s := range g.Keep {
+			kept = append(kept, s.ShortID)
+		}
+		for _, s := range g.Remove {
+			removed = append(removed, s.ShortID)
+		}
+	}
+
+	logrus.Infof("Retention policy applied. kept=%d removed=%d", len(kept), len(removed))
+	return kept, removed, nil
+}
+
+func repairIndex(ctx context.Context, repo *Repository, repairTimeout time.Duration) (command0 string, result0 string, duration0 time.Duration, err0 error) {
+	logrus.Infof("repairIndex()")
+
+	startTime := time.Now()
+	command := []string{"repair", "index"}
+	if !resticSupports("repair index") {
+		//restic < 0.16 only has 'rebuild-index'
+		logrus.Debugf("'repair index' not supported by restic %s. Using 'rebuild-index'", resticVersion)
+		command = []string{"rebuild-index"}
+	}
+	logrus.Infof("Calling Restic...")
+	result, err := repo.ResticTimeout(ctx, repairTimeout, command...)
+	if err != nil {
+		return strings.Join(command, " "), result, -1, err
+	}
+	duration := time.Since(startTime)
+	logrus.Debugf("result: %s", result)
+
+	logrus.Infof("Index repair finished. command=%v duration=%s", command, duration)
+	return strings.Join(command, " "), result, duration, nil
+}
+
+func migrateRepo(ctx context.Context, repo *Repository, migration string, migrateTimeout time.Duration) (map[string]interface{}, error) {
+	logrus.Infof("migrateRepo() migration=%s", migration)
+
+	if migration == "" {
+		result, err := repo.Restic(ctx, "migrate")
+		if err != nil {
+			return nil, err
+		}
+		logrus.Debugf("result: %s", result)
+
+		rex, _ := regexp.Compile("(?m)^\\s+([a-z0-9_]+): (.*)$")
+		available := make([]map[string]string, 0)
+		for _, m := range rex.FindAllStringSubmatch(result, -1) {
+			available = append(available, map[string]string{
+				"name":        m[1],
+				"description": m[2],
+			})
+		}
+		return map[string]interface{}{
+			"applied":             false,
+			"availableMigrations": available,
+		}, nil
+	}
+
+	logrus.Infof("Calling Restic...")
+	startTime := time.Now()
+	result, err := repo.ResticTimeout(ctx, migrateTimeout, "migrate", migration)
+	if err != nil {
+		return nil, err
+	}
+	duration := time.Since(startTime)
+	logrus.Debugf("result: %s", result)
+
+	logrus.Infof("Migration %s finished. duration=%s", migration, duration)
+	return map[string]interface{}{
+		"applied":         true,
+		"migration":       migration,
+		"result":          result,
+		"durationSeconds": duration.Seconds(),
+	}, nil
+}
+
+func unlockRepo(ctx context.Context, repo *Repository, removeAll bool) (int, error) {
+	logrus.Infof("unlockRepo() removeAll=%t", removeAll)
+
+	locksBefore, err := countLocks(ctx, repo)
+	if err != nil {
+		return -1, err
+	}
+
+	args := []string{"unlock"}
+	if removeAll {
+		args = append(args, "--remove-all")
+	}
+	_, err = repo.Restic(ctx, args...)
+	if err != nil {
+		return -1, err
+	}
+
+	locksAfter, err := countLocks(ctx, repo)
+	if err != nil {
+		return -1, err
+	}
+
+	removedLocks := locksBefore - locksAfter
+	logrus.Infof("Repository unlocked. removedLocks=%d remainingLocks=%d", removedLocks, locksAfter)
+	return removedLocks, nil
+}
+
+func countLocks(ctx context.Context, repo *Repository) (int, error) {
+	result, err := repo.Restic(ctx, "list", "locks", "--no-lock")
+	if err != nil {
+		return -1, err
+	}
+	return countLines(result), nil
+}
+
+// RepoKey restic key as returned by 'restic key list --json'
+type RepoKey struct {
+	Current  bool   `json:"current"`
+	ID       string `json:"id"`
+	UserName string `json:"userName"`
+	HostName string `json:"hostName"`
+	Created  string `json:"created"`
+}
+
+func listRepoKeys(ctx context.Context, repo *Repository) ([]RepoKey, error) {
+	result, err := repo.ResticJSON(ctx, 90*time.Second, "key", "list", "--json")
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]RepoKey, 0)
+	err = json.Unmarshal([]byte(result), &keys)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse key list. err=%s result=%s", err, result)
+	}
+	return keys, nil
+}
+
+func addRepoKey(ctx context.Context, repo *Repository, newPassword string) (string, error) {
+	logrus.Infof("addRepoKey()")
+
+	keysBefore, err := listRepoKeys(ctx, repo)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile("", "restic-key")
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create temp file for new key password. err=%s", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(newPassword)
+	f.Close()
+	if err != nil {
+		return "", fmt.Errorf("Couldn't write new key password. err=%s", err)
+	}
+
+	_, err = repo.Restic(ctx, "key", "add", "--new-password-file", f.Name())
+	if err != nil {
+		return "", err
+	}
+
+	keysAfter, err := listRepoKeys(ctx, repo)
+	if err != nil {
+		return "", err
+	}
+	existing := make(map[string]bool)
+	for _, k := range keysBefore {
+		existing[k.ID] = true
+	}
+	for _, k := range keysAfter {
+		if !existing[k.ID] {
+			logrus.Infof("Repository key %s added", k.ID)
+			return k.ID, nil
+		}
+	}
+
+	return "", fmt.Errorf("Couldn't find the id of the added key")
+}
+
+func removeRepoKey(ctx context.Context, repo *Repository, keyID string) error {
+	logrus.Infof("removeRepoKey() keyID=%s", keyID)
+
+	result, err := repo.Restic(ctx, "key", "remove", keyID)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("result: %s", result)
+
+	logrus.Infof("Repository key %s removed", keyID)
+	return nil
+}
+
+func rotateRepoPassword(ctx context.Context, repo *Repository, newPassword string) (oldKeyID0 string, newKeyID0 string, err0 error) {
+	logrus.Infof("rotateRepoPassword() repo=%s", repo.Name)
+
+	keys, err := listRepoKeys(ctx, repo)
+	if err != nil {
+		return "", "", err
+	}
+	oldKeyID := ""
+	for _, k := range keys {
+		if k.Current {
+			oldKeyID = k.ID
+		}
+	}
+	if oldKeyID == "" {
+		return "", "", fmt.Errorf("Couldn't find the key currently in use")
+	}
+
+	newKeyID, err := addRepoKey(ctx, repo, newPassword)
+	if err != nil {
+		return "", "", err
+	}
+
+	//verify the new password opens the repository with the new key before dropping the old one
+	newRepo := repo.withPassword(newPassword)
+	newKeys, err := listRepoKeys(ctx, newRepo)
+	verified := false
+	if err == nil {
+		for _, k := range newKeys {
+			if k.Current && k.ID == newKeyID {
+				verified = true
+			}
+		}
+	}
+	if !verified {
+		logrus.Warnf("Couldn't verify access with the new password. Removing key %s. err=%v", newKeyID, err)
+		err2 := removeRepoKey(ctx, repo, newKeyID)
+		if err2 != nil {
+			logrus.Errorf("Couldn't remove unverified key %s. err=%s", newKeyID, err2)
+		}
+		return "", "", fmt.Errorf("Couldn't verify access to repository with the new password")
+	}
+
+	err = removeRepoKey(ctx, newRepo, oldKeyID)
+	if err != nil {
+		return "", "", err
+	}
+
+	repo.setPassword(newPassword)
+	logrus.Infof("Repository %s password rotated. oldKeyID=%s newKeyID=%s", repo.Name, oldKeyID, newKeyID)
+	return oldKeyID, newKeyID, nil
+}
+
+// resticCacheDir return the local cache dir used by restic
+func resticCacheDir() string {
+	dir := os.Getenv("RESTIC_CACHE_DIR")
+	if dir != "" {
+		return dir
+	}
+	dir = os.Getenv("XDG_CACHE_HOME")
+	if dir != "" {
+		return filepath.Join(dir, "restic")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".cache", "restic")
+}
+
+// watchCacheSize clean up the local restic cache whenever it grows bigger than maxCacheSizeMB
+func watchCacheSize() {
+	cacheDir := resticCacheDir()
+	logrus.Infof("Limiting restic cache %s to %d MB", cacheDir, maxCacheSizeMB)
+	ticker := time.NewTicker(cacheCheckTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-workerContext.Done():
+			return
+		case <-ticker.C:
+		}
+		_, err := os.Stat(cacheDir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		_, size, err := dirStats(cacheDir)
+		if err != nil {
+			logrus.Warnf("Couldn't get size of restic cache %s. err=%s", cacheDir, err)
+			continue
+		}
+		if size <= int64(maxCacheSizeMB)*1024*1024 {
+			continue
+		}
+		logrus.Infof("Restic cache %s has %d bytes, more than %d MB. Cleaning it up", cacheDir, size, maxCacheSizeMB)
+		_, _, err = cleanupCache(workerContext, maxCacheSizeMB)
+		if err != nil {
+			logrus.Warnf("Couldn't clean up restic cache %s. err=%s", cacheDir, err)
+		}
+	}
+}
+
+func cleanupCache(ctx context.Context, maxCacheSizeMB int) (freedBytes0 int64, cacheSizeBytes0 int64, err0 error) {
+	cacheDir := resticCacheDir()
+	logrus.Infof("cleanupCache() cacheDir=%s maxCacheSizeMB=%d", cacheDir, maxCacheSizeMB)
+
+	_, err := os.Stat(cacheDir)
+	if os.IsNotExist(err) {
+		logrus.Debugf("Cache dir %s doesn't exist. Nothing to clean", cacheDir)
+		return 0, 0, nil
+	}
+
+	_, sizeBefore, err := dirStats(cacheDir)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	result, err := resticRunner.Run(ctx, nil, nil, []string{"cache", "--cleanup"})
+	if err != nil {
+		return -1, -1, err
+	}
+	logrus.Debugf("result: %s", result)
+
+	_, size, err := dirStats(cacheDir)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	if maxCacheSizeMB > 0 && size > int64(maxCacheSizeMB)*1024*1024 {
+		//remove the least recently used repository caches until the limit is respected
+		entries, err := ioutil.ReadDir(cacheDir)
+		if err != nil {
+			return -1, -1, fmt.Errorf("Couldn't list cache dir %s. err=%s", cacheDir, err)
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].ModTime().Before(entries[j].ModTime())
+		})
+		for _, e := range entries {
+			if size <= int64(maxCacheSizeMB)*1024*1024 {
+				break
+			}
+			if !e.IsDir() {
+				continue
+			}
+			p := filepath.Join(cacheDir, e.Name())
+			_, entrySize, err := dirStats(p)
+			if err != nil {
+				return -1, -1, err
+			}
+			//restic commands of the repository read and write its cache, so they must not be running while it is removed
+			owner := cacheRepository(ctx, e.Name())
+			if owner != nil {
+				owner.lock.Lock(0)
+			}
+			logrus.Infof("Removing cache %s (%d bytes) to enforce max cache size", p, entrySize)
+			err = os.RemoveAll(p)
+			if owner != nil {
+				owner.lock.Unlock()
+			}
+			if err != nil {
+				return -1, -1, fmt.Errorf("Couldn't remove cache %s. err=%s", p, err)
+			}
+			size = size - entrySize
+		}
+	}
+
+	freedBytes := sizeBefore - size
+	logrus.Infof("Cache cleanup finished. freedBytes=%d cacheSizeBytes=%d", freedBytes, size)
+	return freedBytes, size, nil
+}
+
+func rewriteBackups(ctx context.Context, repo *Repository, excludes []string, dataIDs []string, forget bool, rewriteTimeout time.Duration) (map[string]string, error) {
+	logrus.Infof("rewriteBackups() excludes=%v dataIDs=%v forget=%t", excludes, dataIDs, forget)
+
+	args := []string{"rewrite"}
+	for _, e := range excludes {
+		args = append(args, "--exclude", e)
+	}
+	if forget {
+		args = append(args, "--forget")
+	}
+	args = append(args, dataIDs...)
+
+	logrus.Infof("Calling Restic...")
+	result, err := repo.ResticTimeout(ctx, rewriteTimeout, args...)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("result: %s", result)
+
+	//maps old snapshot ids to the ids of their rewritten versions
+	rexOld, _ := regexp.Compile("^snapshot ([0-9a-f]+) of")
+	rexNew, _ := regexp.Compile("saved new snapshot ([0-9a-f]+)")
+	rewritten := make(map[string]string)
+	oldID := ""
+	for _, line := range strings.Split(result, "\n") {
+		o := rexOld.FindStringSubmatch(line)
+		if len(o) == 2 {
+			oldID = o[1]
+			continue
+		}
+		n := rexNew.FindStringSubmatch(line)
+		if len(n) == 2 && oldID != "" {
+			rewritten[oldID] = n[1]
+			oldID = ""
+		}
+	}
+
+	logrus.Infof("Rewrite finished. rewritten=%v", rewritten)
+	return rewritten, nil
+}
+
+// FileNode file metadata as returned by 'restic ls --json'
+type FileNode struct {
+	Path  string    `json:"path"`
+	Type  string    `json:"type"`
+	Size  int64     `json:"size"`
+	Mode  uint32    `json:"mode"`
+	MTime time.Time `json:"mtime"`
+}
+
+func listFiles(ctx context.Context, repo *Repository, dataID string, pathPrefix string, offset int, limit int, lsTimeout time.Duration) (files0 []FileNode, total0 int, err0 error) {
+	logrus.Infof("listFiles() dataID=%s path=%s offset=%d limit=%d", dataID, pathPrefix, offset, limit)
+
+	args := []string{"ls", "--json", dataID}
+	if pathPrefix != "" {
+		args = append(args, pathPrefix)
+	}
+
+	//snapshots may have millions of files, so only the requested page is kept
+	files := make([]FileNode, 0)
+	total := 0
+	var parseErr error
+	lsCtx, cancel := context.WithTimeout(ctx, lsTimeout)
+	defer cancel()
+	_, err := retryRestic(lsCtx, func() (string, error) {
+		files = files[:0]
+		total = 0
+		parseErr = nil
+		return repo.ResticStream(lsCtx, func(line string) {
+			if parseErr != nil || strings.TrimSpace(line) == "" {
+				return
+			}
+			node := struct {
+				FileNode
+				StructType string `json:"struct_type"`
+			}{}
+			err := json.Unmarshal([]byte(line), &node)
+			if err != nil {
+				parseErr = fmt.Errorf("Couldn't parse ls results. err=%s line=%s", err, line)
+				return
+			}
+			if node.StructType != "node" {
+				return
+			}
+			if total >= offset && (limit <= 0 || len(files) < limit) {
+				files = append(files, node.FileNode)
+			}
+			total = total + 1
+		}, args...)
+	})
+	if err != nil {
+		return nil, -1, err
+	}
+	if parseErr != nil {
+		return nil, -1, parseErr
+	}
+
+	logrus.Debugf("Found %d files. returning=%d", total, len(files))
+	return files, total, nil
+}
+
+func snapshotInfo(ctx context.Context, repo *Repository, dataID string) (map[string]interface{}, error) {
+	logrus.Infof("snapshotInfo() dataID=%s", dataID)
+
+	s, err := findSnapshot(ctx, repo, dataID)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := resticStats(ctx, repo, s.ID, "restore-size")
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"dataId":         s.ShortID,
+		"dataIdFull":     s.ID,
+		"time":           s.Time,
+		"hostname":       s.Hostname,
+		"paths":          s.Paths,
+		"parent":         s.Parent,
+		"tags":           s.Tags,
+		"tree":           s.Tree,
+		"treeSizeMB":     float64(stats.TotalSize) / 1024 / 1024,
+		"totalFileCount": stats.TotalFileCount,
+	}, nil
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flaviostutz/conductor-go-client/task"
+	"github.com/sirupsen/logrus"
+)
+
+// metricFamily values of a metric by their labels, in the Prometheus text format
+type metricFamily struct {
+	help   string
+	kind   string
+	values map[string]float64
+}
+
+var (
+	metricsLock = &sync.Mutex{}
+
+	// metricFamilies metrics served on '/metrics' by name
+	metricFamilies = map[string]*metricFamily{
+		"backtor_tasks_polled_total":           {help: "Tasks polled from Conductor", kind: "counter"},
+		"backtor_tasks_requeued_total":         {help: "Tasks of other shards returned to Conductor", kind: "counter"},
+		"backtor_tasks_total":                  {help: "Tasks run by result status", kind: "counter"},
+		"backtor_task_duration_seconds":        {help: "Duration of tasks", kind: "summary"},
+		"backtor_task_updates_failed_total":    {help: "Progress updates of running tasks that Conductor didn't accept", kind: "counter"},
+		"backtor_backups_total":                {help: "Backups by backupName and status (succeeded or failed)", kind: "counter"},
+		"backtor_backup_bytes_processed_total": {help: "Bytes of the source dirs read by backups", kind: "counter"},
+		"backtor_backup_bytes_added_total":     {help: "Bytes added to the repository by backups, after deduplication and compression", kind: "counter"},
+		"backtor_backup_duration_seconds":      {help: "Duration of the last successful backup", kind: "gauge"},
+		"backtor_backup_last_success_time":     {help: "Unix time of the last successful backup", kind: "gauge"},
+		"backtor_repository_size_bytes":        {help: "Raw size of the repository data after the last backup", kind: "gauge"},
+		"backtor_lock_wait_seconds":            {help: "Time tasks waited for repository locks of this worker (repository) or of Redis (distributed)", kind: "summary"},
+	}
+)
+
+// addMetric add v to the value of a counter with labels (name/value pairs)
+func addMetric(name string, v float64, labels ...string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	f := metricFamilies[name]
+	if f.values == nil {
+		f.values = map[string]float64{}
+	}
+	f.values[metricLabels(labels)] += v
+}
+
+// setMetric set the value of a gauge with labels (name/value pairs)
+func setMetric(name string, v float64, labels ...string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	f := metricFamilies[name]
+	if f.values == nil {
+		f.values = map[string]float64{}
+	}
+	f.values[metricLabels(labels)] = v
+}
+
+// observeMetric add an observation to the _sum and _count of a summary with labels (name/value pairs)
+func observeMetric(name string, d time.Duration, labels ...string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	f := metricFamilies[name]
+	if f.values == nil {
+		f.values = map[string]float64{}
+	}
+	l := metricLabels(labels)
+	f.values["_sum"+l] += d.Seconds()
+	f.values["_count"+l]++
+}
+
+// metricLabels render label pairs as '{name="value",...}'
+func metricLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	escaper := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], escaper.Replace(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// recordTask update the task metrics with the result of a task run by runTask
+func recordTask(t *task.Task, tr *task.TaskResult, err error, duration time.Duration) {
+	status := "failed"
+	if err == nil && tr != nil {
+		status = strings.ToLower(string(tr.Status))
+	}
+	addMetric("backtor_tasks_total", 1, "task", t.TaskType, "status", status)
+	observeMetric("backtor_task_duration_seconds", duration, "task", t.TaskType)
+	if t.TaskType != "backup" {
+		return
+	}
+	backupStatus := "failed"
+	if status == strings.ToLower(string(task.COMPLETED)) {
+		backupStatus = "succeeded"
+	}
+	addMetric("backtor_backups_total", 1, "backup_name", taskBackupName(t), "status", backupStatus)
+}
+
+// recordBackup update the backup metrics with the summary of a successful backup
+func recordBackup(backupName string, repo *Repository, summary *BackupSummary, repoSize int64) {
+	addMetric("backtor_backup_bytes_processed_total", float64(summary.TotalBytesProcessed), "backup_name", backupName)
+	addMetric("backtor_backup_bytes_added_total", float64(summary.DataAdded), "backup_name", backupName)
+	setMetric("backtor_backup_duration_seconds", summary.TotalDuration, "backup_name", backupName)
+	setMetric("backtor_backup_last_success_time", float64(time.Now().Unix()), "backup_name", backupName)
+	if repoSize >= 0 {
+		setMetric("backtor_repository_size_bytes", float64(repoSize), "repository", repo.Name)
+	}
+}
+
+// metricsHandler serve the metrics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metricsLock.Lock()
+	names := []string{}
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		f := metricFamilies[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, f.kind)
+		keys := []string{}
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%s%s %v\n", name, k, f.values[k])
+		}
+	}
+	metricsLock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err := w.Write([]byte(b.String()))
+	if err != nil {
+		logrus.Warnf("Couldn't write metrics response. err=%s", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// registerProcess record a started restic process in dir, so it can be stopped if the worker crashes while it runs
+func registerProcess(dir string, pid int, args []string) {
+	startTime, err := processStartTime(pid)
+	if err != nil {
+		logrus.Debugf("Couldn't get start time of process %d. err=%s", pid, err)
+		return
+	}
+	content := fmt.Sprintf("%s\n%s\n", startTime, commandLine("restic", args))
+	err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.pid", pid)), []byte(content), 0644)
+	if err != nil {
+		logrus.Warnf("Couldn't register restic process %d in %s. err=%s", pid, dir, err)
+	}
+}
+
+// unregisterProcess remove a finished restic process from dir
+func unregisterProcess(dir string, pid int) {
+	err := os.Remove(filepath.Join(dir, fmt.Sprintf("%d.pid", pid)))
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Couldn't unregister restic process %d. err=%s", pid, err)
+	}
+}
+
+// stopOrphanedProcesses stop restic processes registered in dir by a previous worker that are still running, along with the processes
+// they started. Processes whose pid was reused (different start time) are left alone. Returns the number of processes stopped
+func stopOrphanedProcesses(dir string) (int, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't create pid dir %s. err=%s", dir, err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.pid"))
+	if err != nil {
+		return 0, err
+	}
+	stopped := 0
+	for _, file := range files {
+		pid, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(file), ".pid"))
+		if err != nil {
+			os.Remove(file)
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		lines := strings.SplitN(string(data), "\n", 2)
+		startTime, err := processStartTime(pid)
+		if err == nil && startTime == lines[0] {
+			command := ""
+			if len(lines) == 2 {
+				command = strings.TrimSpace(lines[1])
+			}
+			logrus.Warnf("Stopping orphaned restic process %d: '%s'", pid, redactSecrets(command))
+			killOrphan(pid)
+			stopped = stopped + 1
+		}
+		os.Remove(file)
+	}
+	return stopped, nil
+}
+
+// killOrphan send SIGTERM to the process group of pid and SIGKILL if it is still running after killGracePeriod
+func killOrphan(pid int) {
+	syscall.Kill(-pid, syscall.SIGTERM)
+	deadline := time.Now().Add(killGracePeriod)
+	for time.Now().Before(deadline) {
+		if syscall.Kill(pid, 0) != nil {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	logrus.Warnf("Orphaned restic process %d didn't stop after %s. Killing it", pid, killGracePeriod)
+	syscall.Kill(-pid, syscall.SIGKILL)
+}
+
+// processStartTime start time of a process (in clock ticks since boot) as reported by /proc/<pid>/stat
+func processStartTime(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", err
+	}
+	//the command name may have spaces, so fields are counted after its closing parenthesis
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return "", fmt.Errorf("Invalid stat of process %d", pid)
+	}
+	return fields[19], nil
+}
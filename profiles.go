@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+)
+
+// BackupProfile settings of the backupNames matching one of its patterns, so workflows don't need to pass them as task input
+type BackupProfile struct {
+	// BackupNames glob patterns (ex.: 'db-*') of the backupNames using the profile
+	BackupNames   []string `json:"backupNames"`
+	SourcePath    string   `json:"sourcePath"`
+	SourcePaths   []string `json:"sourcePaths"`
+	Excludes      []string `json:"excludes"`
+	Tags          []string `json:"tags"`
+	Host          string   `json:"host"`
+	OneFileSystem *bool    `json:"oneFileSystem"`
+	ExcludeCaches *bool    `json:"excludeCaches"`
+	// ExcludeLargerThan size (ex.: '2G') of the biggest files backed up
+	ExcludeLargerThan string     `json:"excludeLargerThan"`
+	ExcludeIfPresent  []string   `json:"excludeIfPresent"`
+	IgnoreInode       *bool      `json:"ignoreInode"`
+	IgnoreCtime       *bool      `json:"ignoreCtime"`
+	TimeoutSeconds    int        `json:"timeoutSeconds"`
+	Retention         *Retention `json:"retention"`
+}
+
+// Retention snapshots kept by applyRetention when the task has no keep input
+type Retention struct {
+	KeepLast    int    `json:"keepLast"`
+	KeepHourly  int    `json:"keepHourly"`
+	KeepDaily   int    `json:"keepDaily"`
+	KeepWeekly  int    `json:"keepWeekly"`
+	KeepMonthly int    `json:"keepMonthly"`
+	KeepYearly  int    `json:"keepYearly"`
+	KeepWithin  string `json:"keepWithin"`
+}
+
+// backupProfiles profiles of the config file, in the order they are matched
+var backupProfiles = []*BackupProfile{}
+
+// parseProfiles parse the JSON profiles of the config file
+func parseProfiles(data []byte, file string) ([]*BackupProfile, error) {
+	profiles := []*BackupProfile{}
+	err := json.Unmarshal(data, &profiles)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse 'profiles' of config %s. err=%s", file, err)
+	}
+	for i, p := range profiles {
+		if len(p.BackupNames) == 0 {
+			return nil, fmt.Errorf("'backupNames' is required for each profile in %s", file)
+		}
+		for _, pattern := range p.BackupNames {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return nil, fmt.Errorf("Invalid backupName pattern '%s' in profile %d of %s. err=%s", pattern, i, file, err)
+			}
+		}
+	}
+	return profiles, nil
+}
+
+// backupProfile return the first profile matching backupName, or an empty profile if none matches
+func backupProfile(backupName string) *BackupProfile {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	for _, p := range backupProfiles {
+		for _, pattern := range p.BackupNames {
+			match, _ := path.Match(pattern, backupName)
+			if match {
+				return p
+			}
+		}
+	}
+	return &BackupProfile{}
+}
+
+// policy return the restic forget flags of the retention
+func (r *Retention) policy() []string {
+	policy := []string{}
+	keep := []struct {
+		flag  string
+		value int
+	}{{"--keep-last", r.KeepLast}, {"--keep-hourly", r.KeepHourly}, {"--keep-daily", r.KeepDaily}, {"--keep-weekly", r.KeepWeekly}, {"--keep-monthly", r.KeepMonthly}, {"--keep-yearly", r.KeepYearly}}
+	for _, k := range keep {
+		if k.value > 0 {
+			policy = append(policy, k.flag, strconv.Itoa(k.value))
+		}
+	}
+	if r.KeepWithin != "" {
+		policy = append(policy, "--keep-within", r.KeepWithin)
+	}
+	return policy
+}
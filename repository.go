@@ -0,0 +1,851 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flaviostutz/conductor-go-client/task"
+	"github.com/sirupsen/logrus"
+)
+
+// Repository restic repository served by this worker
+type Repository struct {
+	Name               string   `json:"name"`
+	Repo               string   `json:"repo"`
+	Password           string   `json:"password"`
+	PasswordCommand    string   `json:"passwordCommand"`
+	PasswordCommandTTL int      `json:"passwordCommandTTLSeconds"`
+	BackupNamePrefixes []string `json:"backupNamePrefixes"`
+	Tags               []string `json:"tags"`
+	VaultPath          string   `json:"vaultPath"`
+	AppendOnly         bool     `json:"appendOnly"`
+	DeleteRepository   string   `json:"deleteRepository"`
+	PackSizeMB         int      `json:"packSizeMB"`
+
+	//repository URL with credentials, passed to restic in RESTIC_REPOSITORY instead of '-r' so they aren't in the command line
+	repoURL string
+
+	//extended restic options ('-o key=value') and global flags applied to every command
+	options []string
+	flags   []string
+	lock    *RepoLock
+
+	//password obtained from PasswordCommand and when it must be fetched again
+	commandPassword       string
+	commandPasswordExpiry time.Time
+	passwordLock          *sync.Mutex
+
+	//dir with the password and backend credentials files of this repository and their contents while it is watched
+	secretsDir     string
+	secretsCache   map[string]string
+	secretsWatched bool
+
+	//file Password was read from, reloaded when it changes
+	passwordFile string
+
+	//whether Password must be used regardless of secrets files or PasswordCommand
+	passwordPinned bool
+
+	//task 'passwordRef' Password was read from, for repositories requested by tasks
+	passwordRef string
+
+	//repository with delete permission used instead of an append-only one by tasks that delete data
+	deleteRepo *Repository
+
+	//raw size of the repository data and when it was computed with 'restic stats'. Backups of different backupNames update it concurrently
+	rawSize     int64
+	rawSizeTime time.Time
+	rawSizeLock *sync.Mutex
+
+	//repository id from its config, which names its dir in the local restic cache
+	configID string
+}
+
+var (
+	repositories      = []*Repository{}
+	defaultRepository *Repository
+
+	//repository URLs tasks may target with the 'repo' input besides the configured repositories
+	allowedTaskRepos = []string{}
+	taskRepos        = map[string]*Repository{}
+	taskReposLock    = &sync.Mutex{}
+
+	//configureRepository setup backend access for a repository
+	configureRepository = func(r *Repository) error { return nil }
+)
+
+// NewRepository create a repository with its own lock
+func NewRepository(name string, repo string, password string) *Repository {
+	return &Repository{
+		Name:         name,
+		Repo:         repo,
+		Password:     password,
+		lock:         repoLock(repo),
+		passwordLock: &sync.Mutex{},
+		rawSizeLock:  &sync.Mutex{},
+	}
+}
+
+// loadRepositories read additional repositories from a JSON file in the form {"repositories": [{"name", "repo", "password", "backupNamePrefixes", "tags"}]}
+func loadRepositories(file string) ([]*Repository, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read repositories config %s. err=%s", file, err)
+	}
+	return parseRepositories(data, file)
+}
+
+// parseRepositories parse the JSON repositories config read from file
+func parseRepositories(data []byte, file string) ([]*Repository, error) {
+	config := struct {
+		Repositories []*Repository `json:"repositories"`
+	}{}
+	err := json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse repositories config %s. err=%s", file, err)
+	}
+	names := map[string]bool{defaultRepository.Name: true}
+	for _, r := range config.Repositories {
+		if r.Name == "" || r.Repo == "" {
+			return nil, fmt.Errorf("'name' and 'repo' are required for each repository in %s", file)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("Repository name '%s' is duplicated in %s", r.Name, file)
+		}
+		names[r.Name] = true
+		r.lock = repoLock(r.Repo)
+		r.passwordLock = &sync.Mutex{}
+		r.rawSizeLock = &sync.Mutex{}
+	}
+	return config.Repositories, nil
+}
+
+// allRepositories return the configured repositories followed by the default repository
+func allRepositories() []*Repository {
+	all := make([]*Repository, 0, len(repositories)+1)
+	all = append(all, repositories...)
+	return append(all, defaultRepository)
+}
+
+// knownRepositories return the configured repositories and the ones requested by tasks
+func knownRepositories() []*Repository {
+	all := allRepositories()
+	taskReposLock.Lock()
+	defer taskReposLock.Unlock()
+	for _, r := range taskRepos {
+		all = append(all, r)
+	}
+	return all
+}
+
+// cacheID return the id of the repository, which names its dir in the local restic cache
+func (r *Repository) cacheID(ctx context.Context) (string, error) {
+	r.passwordLock.Lock()
+	id := r.configID
+	r.passwordLock.Unlock()
+	if id != "" {
+		return id, nil
+	}
+	result, err := r.ResticJSON(ctx, 90*time.Second, "cat", "config", "--no-lock")
+	if err != nil {
+		return "", err
+	}
+	config := struct {
+		ID string `json:"id"`
+	}{}
+	err = json.Unmarshal([]byte(result), &config)
+	if err != nil || config.ID == "" {
+		return "", fmt.Errorf("Couldn't parse config of repository %s. err=%v", r.Name, err)
+	}
+	r.passwordLock.Lock()
+	r.configID = config.ID
+	r.passwordLock.Unlock()
+	return config.ID, nil
+}
+
+// cacheRepository return the known repository whose local cache is in the cache dir named id, or nil if none is
+func cacheRepository(ctx context.Context, id string) *Repository {
+	for _, r := range knownRepositories() {
+		rid, err := r.cacheID(ctx)
+		if err != nil {
+			logrus.Debugf("Couldn't get the id of repository %s. err=%s", r.Name, err)
+			continue
+		}
+		if rid == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// resolveDeleteRepositories link append-only repositories to the repository named by their 'deleteRepository', which then shares their lock
+func resolveDeleteRepositories() error {
+	for _, r := range allRepositories() {
+		if r.DeleteRepository == "" {
+			continue
+		}
+		if !r.AppendOnly {
+			return fmt.Errorf("Repository %s has a 'deleteRepository' but is not append-only", r.Name)
+		}
+		for _, d := range allRepositories() {
+			if d.Name == r.DeleteRepository && d != r {
+				r.deleteRepo = d
+				d.lock = r.lock
+				shareRepoLock(d.Repo, r.lock)
+			}
+		}
+		if r.deleteRepo == nil {
+			return fmt.Errorf("Delete repository '%s' of repository %s is not configured", r.DeleteRepository, r.Name)
+		}
+	}
+	return nil
+}
+
+// routeRepository return the first repository whose backupName prefixes or tags match, or the default repository
+func routeRepository(backupName string, tags []string) *Repository {
+	for _, r := range repositories {
+		for _, p := range r.BackupNamePrefixes {
+			if backupName != "" && strings.HasPrefix(backupName, p) {
+				return r
+			}
+		}
+		for _, rt := range r.Tags {
+			for _, t := range tags {
+				if rt == t {
+					return r
+				}
+			}
+		}
+	}
+	return defaultRepository
+}
+
+// taskRepository return the repository a task should run against based on its 'repo', 'passwordRef', 'backupName' and 'tags' inputs
+func taskRepository(t *task.Task) (*Repository, error) {
+	passwordRef, _, err := inputString(t, "passwordRef")
+	if err != nil {
+		return nil, err
+	}
+
+	rp, ok, err := inputString(t, "repo")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return overrideRepository(rp, passwordRef)
+	}
+
+	backupName, _, err := inputString(t, "backupName")
+	if err != nil {
+		return nil, err
+	}
+	r := routeRepository(backupName, inputStrings(t, "tags"))
+	if r == nil {
+		return nil, fmt.Errorf("No repository configured")
+	}
+	logrus.Debugf("Using repository %s for backupName=%s", r.Name, backupName)
+	return r, nil
+}
+
+// overrideRepository return the repository explicitly requested by a task, identified by name or URL
+func overrideRepository(repo string, passwordRef string) (*Repository, error) {
+	var found *Repository
+	for _, r := range allRepositories() {
+		if r.Name == repo || r.Repo == repo {
+			found = r
+			break
+		}
+	}
+	if found == nil {
+		allowed := false
+		for _, ar := range allowedTaskRepos {
+			if ar == repo {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("Repository '%s' is not configured nor allowed for tasks", repo)
+		}
+		if passwordRef == "" {
+			return nil, fmt.Errorf("'passwordRef' is required as Input data for repository '%s'", repo)
+		}
+	}
+	if passwordRef == "" {
+		logrus.Debugf("Using repository %s requested by task", found.Name)
+		return found, nil
+	}
+
+	password, err := resolvePasswordRef(passwordRef)
+	if err != nil {
+		return nil, err
+	}
+
+	//reuse the same instance for each repository/password so tasks share its lock
+	taskReposLock.Lock()
+	defer taskReposLock.Unlock()
+	key := repo + "|" + passwordRef
+	r, ok := taskRepos[key]
+	if ok {
+		r.passwordLock.Lock()
+		r.Password = password
+		r.passwordLock.Unlock()
+		return r, nil
+	}
+	if found != nil {
+		r = found.withPassword(password)
+	} else {
+		r = NewRepository(repo, repo, password)
+		err = configureRepository(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.passwordRef = passwordRef
+	taskRepos[key] = r
+	logrus.Debugf("Using repository %s requested by task with password from %s", r.Name, passwordRef)
+	return r, nil
+}
+
+// resolvePasswordRef read a password from a reference in the form 'env:<VAR>' or 'file:<path>'
+func resolvePasswordRef(ref string) (string, error) {
+	if strings.HasPrefix(ref, "env:") {
+		password := os.Getenv(strings.TrimPrefix(ref, "env:"))
+		if password == "" {
+			return "", fmt.Errorf("Password reference %s is empty", ref)
+		}
+		return password, nil
+	}
+	if strings.HasPrefix(ref, "file:") {
+		data, err := ioutil.ReadFile(strings.TrimPrefix(ref, "file:"))
+		if err != nil {
+			return "", fmt.Errorf("Couldn't read password reference %s. err=%s", ref, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", fmt.Errorf("Invalid password reference '%s'. Use 'env:<VAR>' or 'file:<path>'", ref)
+}
+
+// args return the repository argument along with the configured global flags and extended options
+func (r *Repository) args() []string {
+	args := []string{}
+	if r.repoURL == "" {
+		args = append(args, "-r", r.Repo)
+	}
+	args = append(args, r.flags...)
+	if r.PackSizeMB > 0 {
+		args = append(args, "--pack-size", strconv.Itoa(r.PackSizeMB))
+	}
+	for _, o := range r.options {
+		args = append(args, "-o", o)
+	}
+	return args
+}
+
+// deletingRepository return the repository used by operations that delete data. Append-only repositories use their delete repository or fail
+func (r *Repository) deletingRepository(operation string) (*Repository, error) {
+	if !r.AppendOnly {
+		return r, nil
+	}
+	if r.deleteRepo == nil {
+		return nil, fmt.Errorf("Repository %s is append-only and %s would delete data. Configure a 'deleteRepository' with delete permission to allow it", r.Name, operation)
+	}
+	logrus.Debugf("Repository %s is append-only. Running %s with repository %s", r.Name, operation, r.deleteRepo.Name)
+	return r.deleteRepo, nil
+}
+
+// withPassword return a copy of the repository that shares its lock and backend settings but uses another password
+func (r *Repository) withPassword(password string) *Repository {
+	c := NewRepository(r.Name, r.Repo, password)
+	c.repoURL = r.repoURL
+	c.options = r.options
+	c.flags = r.flags
+	c.lock = r.lock
+	c.secretsDir = r.secretsDir
+	c.VaultPath = r.VaultPath
+	c.AppendOnly = r.AppendOnly
+	c.deleteRepo = r.deleteRepo
+	c.PackSizeMB = r.PackSizeMB
+	c.passwordPinned = true
+	return c
+}
+
+// setPassword make the repository use password from now on, instead of its password sources
+func (r *Repository) setPassword(password string) {
+	r.passwordLock.Lock()
+	defer r.passwordLock.Unlock()
+	r.Password = password
+	r.passwordPinned = true
+}
+
+// passwordSource describe where the repository password is read from besides the worker config (a password file, command, secrets dir,
+// Vault or a task 'passwordRef'), or "" if it has none. The worker doesn't write to them
+func (r *Repository) passwordSource() string {
+	switch {
+	case r.passwordRef != "":
+		return "password reference " + r.passwordRef
+	case r.passwordPinned:
+		return ""
+	case r.passwordFile != "":
+		return "password file " + r.passwordFile
+	case r.PasswordCommand != "":
+		return "password command"
+	case r.secretsDir != "":
+		return "secrets dir " + r.secretsDir
+	case r.VaultPath != "":
+		return "Vault path " + r.VaultPath
+	}
+	return ""
+}
+
+// password return the repository password, running PasswordCommand when the cached one has expired
+func (r *Repository) password() (string, error) {
+	r.passwordLock.Lock()
+	pinned, pinnedPassword := r.passwordPinned, r.Password
+	r.passwordLock.Unlock()
+	if pinned {
+		return pinnedPassword, nil
+	}
+	secrets, err := r.secrets()
+	if err != nil {
+		return "", err
+	}
+	password, ok := secrets["password"]
+	if ok {
+		return password, nil
+	}
+	r.passwordLock.Lock()
+	defer r.passwordLock.Unlock()
+	if r.PasswordCommand == "" {
+		return r.Password, nil
+	}
+	if r.commandPassword != "" && time.Now().Before(r.commandPasswordExpiry) {
+		return r.commandPassword, nil
+	}
+
+	//not using ExecCmd because it would log the password
+	logrus.Debugf("Running password command for repository %s", r.Name)
+	out, err := exec.Command("bash", "-c", r.PasswordCommand).Output()
+	if err != nil {
+		return "", fmt.Errorf("Password command for repository %s failed. err=%s", r.Name, err)
+	}
+	password = strings.TrimSpace(string(out))
+	if password == "" {
+		return "", fmt.Errorf("Password command for repository %s returned an empty password", r.Name)
+	}
+	r.commandPassword = password
+	r.commandPasswordExpiry = time.Now().Add(time.Duration(r.PasswordCommandTTL) * time.Second)
+	return password, nil
+}
+
+// env return the environment variables used by restic to access this repository
+func (r *Repository) env() ([]string, error) {
+	password, err := r.password()
+	if err != nil {
+		return nil, err
+	}
+	env := []string{}
+	if r.repoURL != "" {
+		env = append(env, fmt.Sprintf("RESTIC_REPOSITORY=%s", r.repoURL))
+	}
+	if password != "" {
+		env = append(env, fmt.Sprintf("RESTIC_PASSWORD=%s", password))
+	}
+	secrets, err := r.secrets()
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range secrets {
+		if name != "password" {
+			env = append(env, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+	if awsSSO != nil && repoBackend(r.Repo) == "s3" && r.getEnv("AWS_ACCESS_KEY_ID") == "" {
+		creds, err := awsSSO.env()
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, creds...)
+	}
+	if len(env) == 0 {
+		return nil, nil
+	}
+	return env, nil
+}
+
+var secretEnvNameRex = regexp.MustCompile("^[A-Z][A-Z0-9_]*$")
+
+// secrets read the 'password' and backend credentials (named after the restic environment variable, ex.: AWS_ACCESS_KEY_ID) from the repository Vault path and secrets dir.
+// Changed files are picked up without restarting the worker. Files take precedence over Vault values
+func (r *Repository) secrets() (map[string]string, error) {
+	secrets := map[string]string{}
+	if r.VaultPath != "" {
+		if vaultClient == nil {
+			return nil, fmt.Errorf("Repository %s has a Vault path but '--vault-addr' is not set", r.Name)
+		}
+		values, err := vaultClient.read(r.VaultPath)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range values {
+			if name == "password" || secretEnvNameRex.MatchString(name) {
+				secrets[name] = value
+			}
+		}
+	}
+	files, err := r.fileSecrets()
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range files {
+		secrets[name] = value
+	}
+	return secrets, nil
+}
+
+// fileSecrets return the secrets from the repository secrets dir, cached while the dir is watched for changes
+func (r *Repository) fileSecrets() (map[string]string, error) {
+	if r.secretsDir == "" {
+		return map[string]string{}, nil
+	}
+	r.passwordLock.Lock()
+	defer r.passwordLock.Unlock()
+	if r.secretsCache != nil {
+		return r.secretsCache, nil
+	}
+	secrets, err := readSecretsDir(r.secretsDir)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read secrets of repository %s. err=%s", r.Name, err)
+	}
+	if r.secretsWatched {
+		r.secretsCache = secrets
+	}
+	return secrets, nil
+}
+
+// readSecretsDir read the 'password' and credential files of a secrets dir. Empty if the dir doesn't exist
+func readSecretsDir(dir string) (map[string]string, error) {
+	secrets := map[string]string{}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return secrets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || (f.Name() != "password" && !secretEnvNameRex.MatchString(f.Name())) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		secrets[f.Name()] = strings.TrimSpace(string(data))
+	}
+	return secrets, nil
+}
+
+// watchSecrets reload the secrets dir and password file of this repository when they change (ex.: rotated Kubernetes secrets).
+// Running tasks keep the values they started with and new ones are used by the next restic call
+func (r *Repository) watchSecrets() {
+	if r.secretsDir != "" {
+		err := watchDir(r.secretsDir, r.reloadSecretsDir)
+		if err != nil {
+			logrus.Warnf("Couldn't watch secrets dir %s. Reading it on each use. err=%s", r.secretsDir, err)
+		} else {
+			r.passwordLock.Lock()
+			r.secretsWatched = true
+			r.passwordLock.Unlock()
+		}
+	}
+	if r.passwordFile != "" {
+		err := watchDir(filepath.Dir(r.passwordFile), r.reloadPasswordFile)
+		if err != nil {
+			logrus.Warnf("Couldn't watch password file %s. Changes require a restart. err=%s", r.passwordFile, err)
+		}
+	}
+}
+
+// reloadSecretsDir read the secrets dir again, keeping the previous secrets if it can't be read
+func (r *Repository) reloadSecretsDir() {
+	secrets, err := readSecretsDir(r.secretsDir)
+	if err != nil {
+		logrus.Warnf("Couldn't reload secrets of repository %s. Keeping previous secrets. err=%s", r.Name, err)
+		return
+	}
+	r.passwordLock.Lock()
+	defer r.passwordLock.Unlock()
+	if r.secretsCache != nil && !reflect.DeepEqual(secrets, r.secretsCache) {
+		logrus.Infof("Secrets of repository %s changed. Using updated secrets", r.Name)
+	}
+	r.secretsCache = secrets
+}
+
+// reloadPasswordFile read the password file again, keeping the previous password if it can't be read or is empty
+func (r *Repository) reloadPasswordFile() {
+	data, err := ioutil.ReadFile(r.passwordFile)
+	password := strings.TrimSpace(string(data))
+	if err != nil || password == "" {
+		logrus.Warnf("Couldn't reload password file %s of repository %s. Keeping previous password. err=%v", r.passwordFile, r.Name, err)
+		return
+	}
+	r.passwordLock.Lock()
+	defer r.passwordLock.Unlock()
+	if password != r.Password {
+		logrus.Infof("Password file of repository %s changed. Using updated password", r.Name)
+		r.Password = password
+	}
+}
+
+// Restic run a restic command against this repository, stopping it after 90 seconds or when ctx is done
+func (r *Repository) Restic(ctx context.Context, args ...string) (string, error) {
+	return r.ResticTimeout(ctx, 90*time.Second, args...)
+}
+
+// ResticTimeout run a restic command against this repository with timeout
+func (r *Repository) ResticTimeout(ctx context.Context, timeout time.Duration, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return r.resticExec(ctx, nil, args)
+}
+
+// ResticStdout run a restic command against this repository with timeout writing its stdout to stdout
+func (r *Repository) ResticStdout(ctx context.Context, timeout time.Duration, stdout io.Writer, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return r.resticExec(ctx, stdout, args)
+}
+
+// ResticJSON run a restic command with '--json' against this repository with timeout and return its stdout only, so warnings restic
+// prints to stderr (ex.: lock retries or cache issues) don't break the JSON. stderr is in the error of failed commands
+func (r *Repository) ResticJSON(ctx context.Context, timeout time.Duration, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	stdout := ""
+	_, err := retryRestic(ctx, func() (string, error) {
+		out := &bytes.Buffer{}
+		stderr, err := r.resticExec(ctx, out, args)
+		stdout = out.String()
+		return stderr, err
+	})
+	return stdout, err
+}
+
+// ResticStream run a restic command against this repository that is stopped when ctx is done, calling onLine for each stdout line
+// as it is printed instead of buffering it. Returns its stderr
+func (r *Repository) ResticStream(ctx context.Context, onLine func(line string), args ...string) (string, error) {
+	w := &LineWriter{OnLine: func(line string) {
+		if jsonMessage(line).MessageType != "status" {
+			appendTaskLog(ctx, line+"\n")
+		}
+		onLine(line)
+	}}
+	out, err := r.resticExec(ctx, w, args)
+	w.Flush()
+	return out, err
+}
+
+// ResticContext run a restic command against this repository that is stopped when ctx is done
+func (r *Repository) ResticContext(ctx context.Context, args ...string) (string, error) {
+	return r.resticExec(ctx, nil, args)
+}
+
+// resticExec run a restic command against this repository. Commands whose output is buffered are retried on transient errors,
+// while the ones writing to stdout are retried by callers that can discard the output of a failed attempt
+func (r *Repository) resticExec(ctx context.Context, stdout io.Writer, args []string) (string, error) {
+	run := func() (string, error) {
+		env, err := r.env()
+		if err != nil {
+			return "", err
+		}
+		all := append(r.withArgs(args), contextArgs(ctx)...)
+		appendTaskLog(ctx, fmt.Sprintf("$ %s\n", redactSecrets(commandLine("restic", all))))
+		out, err := resticRunner.Run(ctx, env, stdout, all)
+		appendTaskLog(ctx, out+"\n")
+		return out, err
+	}
+	if stdout != nil {
+		return run()
+	}
+	return retryRestic(ctx, run)
+}
+
+// contextArgs restic flags of the task running with ctx (verbosity, bandwidth limits and extended options)
+func contextArgs(ctx context.Context) []string {
+	args := verbosityArgs(ctx)
+	args = append(args, bandwidthArgs(ctx)...)
+	args = append(args, compressionArgs(ctx)...)
+	options, _ := ctx.Value(optionsKey{}).([]string)
+	for _, o := range options {
+		args = append(args, "-o", o)
+	}
+	return args
+}
+
+// compressionKey context key of the compression of a task
+type compressionKey struct{}
+
+// defaultCompression compression of restic commands of tasks that don't set it. restic default (auto) if empty
+var defaultCompression = ""
+
+// withCompression return a ctx whose restic commands write data with compression 'auto', 'max' or 'off'
+func withCompression(ctx context.Context, compression string) context.Context {
+	return context.WithValue(ctx, compressionKey{}, compression)
+}
+
+// compressionArgs restic flags of the compression of ctx
+func compressionArgs(ctx context.Context) []string {
+	compression, ok := ctx.Value(compressionKey{}).(string)
+	if !ok {
+		compression = defaultCompression
+	}
+	if compression == "" {
+		return []string{}
+	}
+	return []string{"--compression", compression}
+}
+
+// parseCompression validate a compression level. Compression requires restic 0.14 and repositories of format version 2
+func parseCompression(value string) (string, error) {
+	switch value {
+	case "":
+		return "", nil
+	case "auto", "max", "off":
+		return value, requireResticFeature("compression")
+	}
+	return "", fmt.Errorf("Invalid compression %s. Use 'auto', 'max' or 'off'", value)
+}
+
+// verbosityKey context key of the restic verbosity of a task
+type verbosityKey struct{}
+
+// defaultVerbosity restic verbosity of tasks that don't set it: -1 is quiet, 0 normal and 1 to 3 verbose levels
+var defaultVerbosity = 0
+
+// withVerbosity return a ctx whose restic commands run with verbosity instead of the default one
+func withVerbosity(ctx context.Context, verbosity int) context.Context {
+	return context.WithValue(ctx, verbosityKey{}, verbosity)
+}
+
+// resticVerbosity verbosity of restic commands run with ctx
+func resticVerbosity(ctx context.Context) int {
+	v, ok := ctx.Value(verbosityKey{}).(int)
+	if !ok {
+		configLock.RLock()
+		defer configLock.RUnlock()
+		return defaultVerbosity
+	}
+	return v
+}
+
+// verbosityArgs '--quiet' or '--verbose' flags of restic commands run with ctx
+func verbosityArgs(ctx context.Context) []string {
+	v := resticVerbosity(ctx)
+	if v < 0 {
+		return []string{"--quiet"}
+	}
+	if v > 0 {
+		return []string{fmt.Sprintf("--verbose=%d", v)}
+	}
+	return []string{}
+}
+
+// parseVerbosity convert 'quiet', 'normal', 'verbose' or 'verbose=<1-3>' to a restic verbosity
+func parseVerbosity(value string) (int, error) {
+	switch value {
+	case "quiet":
+		return -1, nil
+	case "", "normal":
+		return 0, nil
+	case "verbose":
+		return 1, nil
+	}
+	v, err := strconv.Atoi(strings.TrimPrefix(value, "verbose="))
+	if err != nil || v < 1 || v > 3 {
+		return 0, fmt.Errorf("Invalid restic verbosity %s. Use 'quiet', 'normal', 'verbose' or 'verbose=<1-3>'", value)
+	}
+	return v, nil
+}
+
+// taskLogKey context key of the restic output captured for a task
+type taskLogKey struct{}
+
+// maxTaskLogBytes restic output kept in the log of a task. Older output is dropped
+var maxTaskLogBytes = 64 * 1024
+
+// withTaskLog return a ctx whose restic commands and outputs are captured in the returned buffer (returned in 'resticLog' and sent to Conductor task logs)
+func withTaskLog(ctx context.Context) (context.Context, *tailBuffer) {
+	log := &tailBuffer{max: maxTaskLogBytes}
+	return context.WithValue(ctx, taskLogKey{}, log), log
+}
+
+// appendTaskLog add restic output to the log of the task running with ctx, if any
+func appendTaskLog(ctx context.Context, out string) {
+	log, ok := ctx.Value(taskLogKey{}).(*tailBuffer)
+	if ok && strings.TrimSpace(out) != "" {
+		log.Write([]byte(out))
+	}
+}
+
+// optionsKey context key of the extended options ('-o key=value') of a task
+type optionsKey struct{}
+
+// withResticOptions return a ctx whose restic commands have the extended options
+func withResticOptions(ctx context.Context, options []string) context.Context {
+	return context.WithValue(ctx, optionsKey{}, options)
+}
+
+// bandwidthKey context key of the bandwidth limits of a task
+type bandwidthKey struct{}
+
+// bandwidthLimits upload and download limits in KiB/s. Not limited if 0
+type bandwidthLimits struct {
+	upload   int
+	download int
+}
+
+// defaultBandwidth limits of restic commands of tasks that don't override them
+var defaultBandwidth = bandwidthLimits{}
+
+// withBandwidthLimits return a ctx whose restic commands use upload/download limits (KiB/s) instead of the default ones
+func withBandwidthLimits(ctx context.Context, upload int, download int) context.Context {
+	return context.WithValue(ctx, bandwidthKey{}, bandwidthLimits{upload: upload, download: download})
+}
+
+// bandwidthArgs restic flags limiting the bandwidth of commands run with ctx
+func bandwidthArgs(ctx context.Context) []string {
+	limits, ok := ctx.Value(bandwidthKey{}).(bandwidthLimits)
+	if !ok {
+		configLock.RLock()
+		limits = defaultBandwidth
+		configLock.RUnlock()
+	}
+	args := []string{}
+	if limits.upload > 0 {
+		args = append(args, "--limit-upload", strconv.Itoa(limits.upload))
+	}
+	if limits.download > 0 {
+		args = append(args, "--limit-download", strconv.Itoa(limits.download))
+	}
+	return args
+}
+
+// withArgs return restic command arguments followed by the repository arguments
+func (r *Repository) withArgs(args []string) []string {
+	all := make([]string, 0, len(args)+len(r.flags)+2*len(r.options)+2)
+	all = append(all, args...)
+	return append(all, r.args()...)
+}
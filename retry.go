@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// resticRetries times a restic command that failed with a transient error is run again
+	resticRetries = 3
+	// resticRetryBackoff wait before the first retry. It doubles on each retry up to maxRetryBackoff
+	resticRetryBackoff = 5 * time.Second
+	maxRetryBackoff    = 5 * time.Minute
+)
+
+// transientErrors lowercase restic/backend messages of failures that usually succeed when tried again
+var transientErrors = []string{
+	"repository is already locked",
+	"unable to create lock",
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"i/o timeout",
+	"tls handshake timeout",
+	"no such host",
+	"temporary failure",
+	"unexpected eof",
+	"500 internal server error",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+	"slowdown",
+	"requesttimeout",
+	"too many requests",
+}
+
+// isTransient whether a restic failure was caused by a temporary condition (network, backend 5xx, lock contention)
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, timedOut := err.(*CmdTimeoutError)
+	if timedOut {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, t := range transientErrors {
+		if strings.Contains(msg, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryRestic run fn again with exponential backoff while it fails with a transient error, up to resticRetries times or until ctx is done
+func retryRestic(ctx context.Context, fn func() (string, error)) (string, error) {
+	configLock.RLock()
+	backoff, retries := resticRetryBackoff, resticRetries
+	configLock.RUnlock()
+	for attempt := 0; ; attempt++ {
+		out, err := fn()
+		if err == nil || attempt >= retries || ctx.Err() != nil || !isTransient(err) {
+			return out, err
+		}
+		logrus.Warnf("restic failed with a transient error. Retrying in %s (%d/%d). err=%s", backoff, attempt+1, retries, err)
+		select {
+		case <-ctx.Done():
+			return out, err
+		case <-time.After(backoff):
+		}
+		backoff = backoff * 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ResticRunner execute restic commands. Alternative drivers (ex.: container, SSH) and fakes are plugged by setting resticRunner
+type ResticRunner interface {
+	// Run execute restic with args and additional env, writing stdout to stdout when not nil, and return its output
+	Run(ctx context.Context, env []string, stdout io.Writer, args []string) (string, error)
+}
+
+// resticRunner runner used by all restic invocations
+var resticRunner ResticRunner = &ExecRunner{Binary: "restic"}
+
+// resolved path of the restic binary and the version it reports, checked at startup
+var (
+	resticPath    string
+	resticVersion string
+)
+
+// checkResticBinary resolve bin in PATH (or use it as is when it is a path), verify it is executable and return its absolute path and version
+func checkResticBinary(bin string) (string, string, error) {
+	path, err := exec.LookPath(bin)
+	if err != nil {
+		return "", "", fmt.Errorf("Restic binary %s not found or not executable. err=%s", bin, err)
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", "", err
+	}
+	out, err := ExecCmd(path, "version")
+	if err != nil {
+		return "", "", fmt.Errorf("Couldn't run %s version. err=%s", path, err)
+	}
+	rex, _ := regexp.Compile("restic ([0-9][0-9a-zA-Z.-]*)")
+	v := rex.FindStringSubmatch(out)
+	if len(v) != 2 {
+		return "", "", fmt.Errorf("Couldn't detect restic version of %s. out=%s", path, out)
+	}
+	return path, v[1], nil
+}
+
+// resticFeatures minimum restic version of optional features
+var resticFeatures = map[string]string{
+	"exclude-larger-than": "0.10.0",
+	"ignore-ctime":        "0.12.0",
+	"dry-run":             "0.13.0",
+	"compression":         "0.14.0",
+	"copy":                "0.14.0",
+	"pack-size":           "0.14.0",
+	"rewrite":             "0.15.0",
+	"repair index":        "0.16.0",
+}
+
+// resticSupports whether the detected restic version has feature. True when the version is unknown
+func resticSupports(feature string) bool {
+	min, ok := resticFeatures[feature]
+	if !ok || resticVersion == "" {
+		return true
+	}
+	return compareVersions(resticVersion, min) >= 0
+}
+
+// requireResticFeature return an error explaining the required version when the detected restic doesn't have feature
+func requireResticFeature(feature string) error {
+	if !resticSupports(feature) {
+		return fmt.Errorf("'%s' requires restic %s or newer. Found %s", feature, resticFeatures[feature], resticVersion)
+	}
+	return nil
+}
+
+// compareVersions compare dotted versions (ex.: '0.16.4', '0.17.0-dev') numerically. Returns -1, 0 or 1
+func compareVersions(a string, b string) int {
+	pa := strings.Split(a, ".")
+	pb := strings.Split(b, ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		va := 0
+		vb := 0
+		if i < len(pa) {
+			va = versionNumber(pa[i])
+		}
+		if i < len(pb) {
+			vb = versionNumber(pb[i])
+		}
+		if va < vb {
+			return -1
+		}
+		if va > vb {
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionNumber leading number of a version part, ignoring suffixes like '-dev'
+func versionNumber(part string) int {
+	end := 0
+	for end < len(part) && part[end] >= '0' && part[end] <= '9' {
+		end = end + 1
+	}
+	n, _ := strconv.Atoi(part[:end])
+	return n
+}
+
+// ExecRunner run the local restic binary, optionally with resource limits and reduced CPU/IO priority
+type ExecRunner struct {
+	Binary string
+	Limits *ResourceLimits
+	// Nice niceness (1-19) restic runs with. Unchanged if 0
+	Nice int
+	// IONice IO scheduling class ('idle' or 'best-effort:<0-7>') restic runs with. Unchanged if empty
+	IONice string
+	// PidDir dir where running restic processes are registered, so the ones left behind by a crashed worker are stopped on startup
+	PidDir string
+	// Slots bound how many restic processes run at the same time. Unbounded if nil
+	Slots chan struct{}
+}
+
+// Run execute the restic binary
+func (e *ExecRunner) Run(ctx context.Context, env []string, stdout io.Writer, args []string) (string, error) {
+	command := append(e.priorityCommand(), e.Binary)
+	command = append(command, args...)
+	if e.Slots != nil {
+		startTime := time.Now()
+		select {
+		case e.Slots <- struct{}{}:
+			defer func() { <-e.Slots }()
+		case <-ctx.Done():
+			cmd := redactSecrets(strings.Join(command, " "))
+			if ctx.Err() == context.DeadlineExceeded {
+				return "", &CmdTimeoutError{Command: cmd, Timeout: time.Since(startTime).Round(time.Second), Output: "waiting for other restic commands to finish"}
+			}
+			return "", fmt.Errorf("Command canceled: '%s'; out=waiting for other restic commands to finish", cmd)
+		}
+		waited := time.Since(startTime)
+		if waited > time.Second {
+			logrus.Debugf("Waited %s for other restic commands to finish", waited.Round(time.Second))
+		}
+	}
+	pid := 0
+	onStart := func(p int) {
+		pid = p
+		if e.Limits != nil {
+			e.Limits.apply(p)
+		}
+		if e.PidDir != "" {
+			registerProcess(e.PidDir, p, args)
+		}
+	}
+	out, err := execCmd(ctx, env, stdout, onStart, command[0], command[1:]...)
+	if e.PidDir != "" && pid != 0 {
+		unregisterProcess(e.PidDir, pid)
+	}
+	return out, err
+}
+
+// priorityCommand 'ionice' and 'nice' commands restic is started with, so that the priority applies to all its threads and child processes
+func (e *ExecRunner) priorityCommand() []string {
+	command := []string{}
+	if e.IONice != "" {
+		class := strings.SplitN(e.IONice, ":", 2)
+		if class[0] == "idle" {
+			command = append(command, "ionice", "-c", "3")
+		} else {
+			command = append(command, "ionice", "-c", "2")
+			if len(class) == 2 {
+				command = append(command, "-n", class[1])
+			}
+		}
+	}
+	if e.Nice != 0 {
+		command = append(command, "nice", "-n", strconv.Itoa(e.Nice))
+	}
+	return command
+}
+
+// checkPriority validate the priority options and that the commands used to apply them are available
+func (e *ExecRunner) checkPriority() error {
+	if e.Nice < 0 || e.Nice > 19 {
+		return fmt.Errorf("Nice must be between 0 and 19")
+	}
+	if e.IONice != "" {
+		class := strings.SplitN(e.IONice, ":", 2)
+		if class[0] != "idle" && class[0] != "best-effort" {
+			return fmt.Errorf("IO priority class must be 'idle' or 'best-effort'. Found %s", class[0])
+		}
+		if len(class) == 2 {
+			level, err := strconv.Atoi(class[1])
+			if err != nil || level < 0 || level > 7 {
+				return fmt.Errorf("best-effort IO priority level must be between 0 and 7. Found %s", class[1])
+			}
+		}
+	}
+	for _, c := range e.priorityCommand() {
+		if c == "ionice" || c == "nice" {
+			_, err := exec.LookPath(c)
+			if err != nil {
+				return fmt.Errorf("'%s' is required to change restic priority. err=%s", c, err)
+			}
+		}
+	}
+	return nil
+}
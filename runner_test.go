@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// FakeResponse scripted result of restic commands whose args start with Args
+type FakeResponse struct {
+	Args   []string
+	Output string
+	// Stderr printed by the command besides Output, which goes to stdout
+	Stderr string
+	Err    error
+	// Once whether the response is only returned to the first matching command, so later ones get the next response
+	Once bool
+	used bool
+}
+
+// FakeRunner scripted restic used to exercise task logic without a restic binary or repository
+type FakeRunner struct {
+	Responses []FakeResponse
+	Calls     [][]string
+	lock      sync.Mutex
+}
+
+// Run record the call and return the first response whose Args prefix the command args
+func (f *FakeRunner) Run(ctx context.Context, env []string, stdout io.Writer, args []string) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.Calls = append(f.Calls, args)
+	for i := range f.Responses {
+		r := &f.Responses[i]
+		if r.used || !hasArgsPrefix(args, r.Args) {
+			continue
+		}
+		r.used = r.Once
+		if stdout != nil {
+			_, err := io.WriteString(stdout, r.Output)
+			if err != nil {
+				return "", err
+			}
+			return r.Stderr, r.Err
+		}
+		return joinOutput(r.Output, r.Stderr), r.Err
+	}
+	return "", fmt.Errorf("Unexpected restic command: restic %s", strings.Join(args, " "))
+}
+
+func hasArgsPrefix(args []string, prefix []string) bool {
+	if len(prefix) > len(args) {
+		return false
+	}
+	for i, p := range prefix {
+		if args[i] != p {
+			return false
+		}
+	}
+	return true
+}
+
+// called whether restic was run with args starting with prefix
+func (f *FakeRunner) called(prefix ...string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, c := range f.Calls {
+		if hasArgsPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
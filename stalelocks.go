@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ResticLock lock file of a restic operation, as printed by 'restic cat lock'
+type ResticLock struct {
+	Time      time.Time `json:"time"`
+	Exclusive bool      `json:"exclusive"`
+	Hostname  string    `json:"hostname"`
+	Username  string    `json:"username"`
+	PID       int       `json:"pid"`
+}
+
+// staleLockAge age after which a lock is considered left behind by an operation that died. restic itself never removes locks newer than 30 minutes of
+// other hosts, so lower values behave as 30 minutes
+var staleLockAge = 30 * time.Minute
+
+// resticStaleLockAge age after which 'restic unlock' removes locks of other hosts
+var resticStaleLockAge = 30 * time.Minute
+
+var lockIDRegex = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// removeStaleLocks run 'restic unlock' only when the repository has stale locks (older than staleLockAge, or of processes of this host that are no longer running)
+// and every lock restic would remove is stale. Otherwise the locks are left to their operations and restic waits for them, retrying while the repository is locked
+func removeStaleLocks(ctx context.Context, repo *Repository) error {
+	result, err := repo.Restic(ctx, "list", "locks", "--no-lock")
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	configLock.RLock()
+	maxAge := staleLockAge
+	configLock.RUnlock()
+	stale := 0
+	for _, line := range strings.Split(result, "\n") {
+		id := strings.TrimSpace(line)
+		if !lockIDRegex.MatchString(id) {
+			continue
+		}
+		out, err := repo.Restic(ctx, "cat", "lock", id, "--no-lock")
+		if err != nil {
+			//the lock may have been removed by its operation meanwhile
+			logrus.Debugf("Couldn't read lock %s of repository %s. err=%s", id[:8], repo.Name, err)
+			continue
+		}
+		lock := ResticLock{}
+		start := strings.Index(out, "{")
+		end := strings.LastIndex(out, "}")
+		if start < 0 || end < start {
+			logrus.Debugf("Invalid lock %s of repository %s. out=%s", id[:8], repo.Name, out)
+			continue
+		}
+		err = json.Unmarshal([]byte(out[start:end+1]), &lock)
+		if err != nil {
+			logrus.Debugf("Invalid lock %s of repository %s. err=%s", id[:8], repo.Name, err)
+			continue
+		}
+		age := time.Since(lock.Time)
+		deadProcess := lock.Hostname == hostname && !processRunning(lock.PID)
+		if deadProcess || age > maxAge {
+			logrus.Infof("Lock %s of repository %s is stale. host=%s pid=%d age=%s", id[:8], repo.Name, lock.Hostname, lock.PID, age.Round(time.Second))
+			stale = stale + 1
+			continue
+		}
+		if age > resticStaleLockAge {
+			logrus.Infof("Lock %s of repository %s (host=%s pid=%d age=%s) is still in use. Not removing stale locks", id[:8], repo.Name, lock.Hostname, lock.PID, age.Round(time.Second))
+			return nil
+		}
+		logrus.Debugf("Repository %s is locked by host=%s pid=%d exclusive=%t", repo.Name, lock.Hostname, lock.PID, lock.Exclusive)
+	}
+	if stale == 0 {
+		return nil
+	}
+	_, err = repo.Restic(ctx, "unlock")
+	if err != nil {
+		return fmt.Errorf("Couldn't remove stale locks of repository %s. err=%s", repo.Name, err)
+	}
+	return nil
+}
+
+// processRunning whether a process with pid exists on this host
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -3,10 +3,119 @@ set -e
 # set -x
 
 echo "Starting Restic API..."
-backtor-restic \
-    --restic-password="$RESTIC_PASSWORD" \
-    --log-level="$LOG_LEVEL" \
-    --conductor-url="$CONDUCTOR_API_URL" \
-    --repo-dir="$REPO_DIR" \
-    --source-path="$SOURCE_DATA_PATH"
+#only flags with a value are passed, so the others can be set by BACKTOR_RESTIC_ env variables or the config file
+args=()
+add_flag() {
+    if [ -n "$2" ]; then
+        args+=("--$1=$2")
+    fi
+}
+add_flag restic-password-file "$RESTIC_PASSWORD_FILE"
+add_flag restic-password-command "$RESTIC_PASSWORD_COMMAND"
+add_flag restic-password-command-ttl "$RESTIC_PASSWORD_COMMAND_TTL"
+add_flag config "$CONFIG_FILE"
+add_flag log-level "$LOG_LEVEL"
+add_flag restic-bin "$RESTIC_BIN"
+add_flag restic-min-version "$RESTIC_MIN_VERSION"
+add_flag restic-download-version "$RESTIC_DOWNLOAD_VERSION"
+add_flag restic-download-sha256 "$RESTIC_DOWNLOAD_SHA256"
+add_flag restic-download-dir "$RESTIC_DOWNLOAD_DIR"
+add_flag no-init "$NO_INIT"
+add_flag restic-cache-dir "$RESTIC_CACHE_DIR"
+add_flag max-cache-size-mb "$MAX_CACHE_SIZE_MB"
+add_flag restic-cpu-weight "$RESTIC_CPU_WEIGHT"
+add_flag restic-memory-max-mb "$RESTIC_MEMORY_MAX_MB"
+add_flag restic-nice "$RESTIC_NICE"
+add_flag restic-ionice "$RESTIC_IONICE"
+add_flag limit-upload "$LIMIT_UPLOAD_KB"
+add_flag limit-download "$LIMIT_DOWNLOAD_KB"
+add_flag pid-dir "$PID_DIR"
+add_flag restic-retries "$RESTIC_RETRIES"
+add_flag restic-retry-backoff-seconds "$RESTIC_RETRY_BACKOFF_SECONDS"
+add_flag restic-opt "$RESTIC_OPTS"
+add_flag restic-verbosity "$RESTIC_VERBOSITY"
+add_flag allowed-task-restic-opts "$ALLOWED_TASK_RESTIC_OPTS"
+add_flag status-addr "$STATUS_ADDR"
+add_flag conductor-url "$CONDUCTOR_API_URL"
+add_flag task-status-check-seconds "$TASK_STATUS_CHECK_SECONDS"
+add_flag task-threads "$TASK_THREADS"
+add_flag max-concurrent-restic "$MAX_CONCURRENT_RESTIC"
+add_flag stale-lock-minutes "$STALE_LOCK_MINUTES"
+add_flag task-priorities "$TASK_PRIORITIES"
+add_flag default-backup-timeout "$DEFAULT_BACKUP_TIMEOUT"
+add_flag default-task-timeout "$DEFAULT_TASK_TIMEOUT"
+add_flag default-remove-timeout "$DEFAULT_REMOVE_TIMEOUT"
+add_flag shard "$SHARD"
+add_flag redis-addr "$REDIS_ADDR"
+add_flag redis-db "$REDIS_DB"
+add_flag distributed-lock-ttl-seconds "$DISTRIBUTED_LOCK_TTL_SECONDS"
+add_flag task-logs "$TASK_LOGS"
+add_flag progress-update-seconds "$PROGRESS_UPDATE_SECONDS"
+add_flag repo-size-refresh-seconds "$REPO_SIZE_REFRESH_SECONDS"
+add_flag repo-dir "$REPO_DIR"
+add_flag repos-config-file "$REPOS_CONFIG_FILE"
+add_flag allowed-task-repos "$ALLOWED_TASK_REPOS"
+add_flag allowed-source-paths "$ALLOWED_SOURCE_PATHS"
+add_flag append-only "$APPEND_ONLY"
+add_flag delete-repository "$DELETE_REPOSITORY"
+add_flag secrets-dir "$SECRETS_DIR"
+add_flag vault-addr "$VAULT_ADDR"
+add_flag vault-role-id "$VAULT_ROLE_ID"
+add_flag vault-secret-id "$VAULT_SECRET_ID"
+add_flag vault-k8s-role "$VAULT_K8S_ROLE"
+add_flag vault-k8s-token-file "$VAULT_K8S_TOKEN_FILE"
+add_flag vault-auth-path "$VAULT_AUTH_PATH"
+add_flag vault-ca-cert-file "$VAULT_CACERT"
+add_flag vault-path "$VAULT_PATH"
+add_flag vault-secrets-ttl "$VAULT_SECRETS_TTL"
+add_flag copy-repo-dir "$COPY_REPO_DIR"
+add_flag copy-restic-password "$COPY_RESTIC_PASSWORD"
+add_flag aws-access-key-id "$AWS_ACCESS_KEY_ID"
+add_flag aws-secret-access-key "$AWS_SECRET_ACCESS_KEY"
+add_flag aws-region "$AWS_DEFAULT_REGION"
+add_flag aws-profile "$AWS_PROFILE"
+add_flag s3-endpoint "$S3_ENDPOINT"
+add_flag s3-path-style "$S3_PATH_STYLE"
+add_flag s3-region "$S3_REGION"
+add_flag s3-ca-cert-file "$S3_CA_CERT_FILE"
+add_flag s3-insecure-tls "$S3_INSECURE_TLS"
+add_flag b2-account-id "$B2_ACCOUNT_ID"
+add_flag b2-account-key "$B2_ACCOUNT_KEY"
+add_flag b2-connections "$B2_CONNECTIONS"
+add_flag azure-account-name "$AZURE_ACCOUNT_NAME"
+add_flag azure-account-key "$AZURE_ACCOUNT_KEY"
+add_flag azure-account-sas "$AZURE_ACCOUNT_SAS"
+add_flag gcs-project-id "$GOOGLE_PROJECT_ID"
+add_flag gcs-credentials-file "$GOOGLE_APPLICATION_CREDENTIALS"
+add_flag gcs-credentials-json "$GOOGLE_CREDENTIALS_JSON"
+add_flag sftp-key-file "$SFTP_KEY_FILE"
+add_flag sftp-port "$SFTP_PORT"
+add_flag sftp-known-hosts-file "$SFTP_KNOWN_HOSTS_FILE"
+add_flag sftp-accept-new-host-keys "$SFTP_ACCEPT_NEW_HOST_KEYS"
+add_flag rest-username "$REST_USERNAME"
+add_flag rest-password "$REST_PASSWORD"
+add_flag ca-cert-file "$CA_CERT_FILE"
+add_flag tls-client-cert-file "$TLS_CLIENT_CERT_FILE"
+add_flag rclone-config-file "$RCLONE_CONFIG"
+add_flag swift-auth-url "$OS_AUTH_URL"
+add_flag swift-region "$OS_REGION_NAME"
+add_flag swift-username "$OS_USERNAME"
+add_flag swift-password "$OS_PASSWORD"
+add_flag swift-tenant "$OS_TENANT_NAME"
+add_flag swift-domain "$OS_DOMAIN_NAME"
+add_flag source-dir-template "$SOURCE_DIR_TEMPLATE"
+add_flag exclude "$BACKUP_EXCLUDES"
+add_flag exclude-if-present "$EXCLUDE_IF_PRESENT"
+add_flag ignore-file-name "$IGNORE_FILE_NAME"
+add_flag tag "$BACKUP_TAGS"
+add_flag snapshot-host "$SNAPSHOT_HOST"
+add_flag one-file-system "$ONE_FILE_SYSTEM"
+add_flag exclude-caches "$EXCLUDE_CACHES"
+add_flag exclude-larger-than "$EXCLUDE_LARGER_THAN"
+add_flag ignore-inode "$IGNORE_INODE"
+add_flag ignore-ctime "$IGNORE_CTIME"
+add_flag compression "$COMPRESSION"
+add_flag pack-size "$PACK_SIZE_MB"
+add_flag source-path "$SOURCE_DATA_PATH"
 
+exec backtor-restic "${args[@]}"
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	readinessLock = &sync.Mutex{}
+
+	// readinessCheckInterval wait between the readiness checks run in background. Probes get the result of the last one
+	readinessCheckInterval = 30 * time.Second
+
+	lastReadiness map[string]interface{}
+)
+
+// startStatusServer serve the worker status endpoints on addr in background
+func startStatusServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	go watchReadiness()
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			logrus.Errorf("Status server on %s stopped. err=%s", addr, err)
+		}
+	}()
+	logrus.Infof("Serving status on %s", addr)
+}
+
+// statusHandler report the restic binary used by the worker and the optional features its version supports
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	features := map[string]bool{}
+	for f := range resticFeatures {
+		features[f] = resticSupports(f)
+	}
+	status := map[string]interface{}{
+		"restic": map[string]interface{}{
+			"path":     resticPath,
+			"version":  resticVersion,
+			"features": features,
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		logrus.Warnf("Couldn't write status response. err=%s", err)
+	}
+}
+
+// healthzHandler report that the worker process is alive
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler report whether Conductor and all repositories are reachable, with 503 if any of them isn't or the worker is stopping
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	readiness := currentReadiness()
+	w.Header().Set("Content-Type", "application/json")
+	if !readiness["ready"].(bool) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(readiness)
+	if err != nil {
+		logrus.Warnf("Couldn't write readiness response. err=%s", err)
+	}
+}
+
+// currentReadiness return the result of the last readiness check, not ready while the first one runs or the worker is stopping
+func currentReadiness() map[string]interface{} {
+	if workerContext.Err() != nil {
+		return map[string]interface{}{"ready": false, "stopping": true}
+	}
+	readinessLock.Lock()
+	defer readinessLock.Unlock()
+	if lastReadiness == nil {
+		return map[string]interface{}{"ready": false, "checking": true}
+	}
+	return lastReadiness
+}
+
+// watchReadiness check the readiness every readinessCheckInterval until the worker stops. restic may take long to reach a
+// repository or wait behind other commands, so probes don't run the checks themselves
+func watchReadiness() {
+	for {
+		readiness := checkReadiness()
+		readinessLock.Lock()
+		lastReadiness = readiness
+		readinessLock.Unlock()
+		select {
+		case <-workerContext.Done():
+			return
+		case <-time.After(readinessCheckInterval):
+		}
+	}
+}
+
+// checkReadiness check Conductor and the repositories
+func checkReadiness() map[string]interface{} {
+	ready := true
+	conductor := "ok"
+	err := checkConductor()
+	if err != nil {
+		logrus.Warnf("Conductor %s is not reachable. err=%s", conductorURL, err)
+		conductor = redactSecrets(err.Error())
+		ready = false
+	}
+	repositories := map[string]string{}
+	for _, repo := range allRepositories() {
+		ctx, cancel := context.WithTimeout(workerContext, 30*time.Second)
+		_, err := repo.Restic(ctx, "cat", "config")
+		cancel()
+		if err != nil {
+			logrus.Warnf("Repository %s is not reachable. err=%s", repo.Name, err)
+			repositories[repo.Name] = redactSecrets(err.Error())
+			ready = false
+			continue
+		}
+		repositories[repo.Name] = "ok"
+	}
+	return map[string]interface{}{
+		"ready":        ready,
+		"conductor":    conductor,
+		"repositories": repositories,
+	}
+}
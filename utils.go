@@ -1,69 +1,389 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/go-cmd/cmd"
+	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
 )
 
-//ExecShellf execute shell command
-func ExecShellf(command string, args ...interface{}) (string, error) {
-	return ExecShellfTimeout(90*time.Second, command, args...)
-}
-
-//ExecShellTimeout execute shell command with timeout
-func ExecShellfTimeout(timeout time.Duration, command string, args ...interface{}) (string, error) {
-	command1 := fmt.Sprintf(command, args...)
-	logrus.Debugf("shell command: '%s'", command1)
-	acmd := cmd.NewCmd("bash", "-c", command1)
-	statusChan := acmd.Start() // non-blocking
-	running := true
-	// if ctx != nil {
-	// 	ctx.CmdRef = acmd
-	// }
-
-	//kill if taking too long
-	if timeout > 0 {
-		logrus.Debugf("Enforcing timeout %s", timeout)
-		go func() {
-			startTime := time.Now()
-			for running {
-				if time.Since(startTime) >= timeout {
-					logrus.Warnf("Stopping command execution because it is taking too long (%d seconds)", time.Since(startTime))
-					acmd.Stop()
-				}
-				time.Sleep(1 * time.Second)
+//ExecCmd execute a command without a shell. Arguments are passed as is to the process
+func ExecCmd(name string, args ...string) (string, error) {
+	return ExecCmdEnvTimeout(nil, 90*time.Second, name, args...)
+}
+
+//ExecCmdEnvTimeout execute a command with additional environment variables and timeout
+func ExecCmdEnvTimeout(env []string, timeout time.Duration, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(workerContext, timeout)
+	defer cancel()
+	return ExecCmdContext(ctx, env, nil, name, args...)
+}
+
+//killGracePeriod time between SIGTERM and SIGKILL when stopping a command
+var killGracePeriod = 10 * time.Second
+
+//CmdTimeoutError command failed because it didn't finish before its timeout
+type CmdTimeoutError struct {
+	Command string
+	Timeout time.Duration
+	Output  string
+}
+
+func (e *CmdTimeoutError) Error() string {
+	return fmt.Sprintf("Command timed out after %s: '%s'; out=%s", e.Timeout, e.Command, e.Output)
+}
+
+//CmdError command failed with a non zero exit code
+type CmdError struct {
+	Command  string
+	ExitCode int
+	Output   string
+}
+
+func (e *CmdError) Error() string {
+	return fmt.Sprintf("Failed to run command: '%s'; exit=%d; out=%s", e.Command, e.ExitCode, e.Output)
+}
+
+//ExecCmdContext execute a command that is stopped when ctx is done (timeout, task cancellation or worker shutdown).
+//stdout is written to stdout instead of being returned (returned output has stderr only) unless it is nil
+func ExecCmdContext(ctx context.Context, env []string, stdout io.Writer, name string, args ...string) (string, error) {
+	return execCmd(ctx, env, stdout, nil, name, args...)
+}
+
+//workerOnlyEnv env variables of the worker that restic must not inherit. They configure the default repository of the worker,
+//which is passed to restic with '-r' and RESTIC_PASSWORD. restic refuses to run with both '-r' and RESTIC_REPOSITORY_FILE, and
+//an inherited RESTIC_PASSWORD_FILE would take precedence over the password of other repositories
+var workerOnlyEnv = []string{"RESTIC_REPOSITORY", "RESTIC_REPOSITORY_FILE", "RESTIC_PASSWORD", "RESTIC_PASSWORD_FILE", "RESTIC_PASSWORD_COMMAND",
+	"RESTIC_FROM_REPOSITORY", "RESTIC_FROM_REPOSITORY_FILE", "RESTIC_FROM_PASSWORD", "RESTIC_FROM_PASSWORD_FILE", "RESTIC_FROM_PASSWORD_COMMAND"}
+
+//childEnv return the worker environment without workerOnlyEnv, so commands only get the values of the repository passed to them
+func childEnv() []string {
+	env := []string{}
+	for _, e := range os.Environ() {
+		inherited := true
+		for _, name := range workerOnlyEnv {
+			if strings.HasPrefix(e, name+"=") {
+				inherited = false
 			}
-		}()
+		}
+		if inherited {
+			env = append(env, e)
+		}
 	}
+	return env
+}
 
-	// logrus.Debugf("Waiting for command to finish...")
-	<-statusChan
-	// logrus.Debugf("Command finished")
-	running = false
+//execCmd execute a command like ExecCmdContext, calling onStart with its pid right after it is started when not nil
+func execCmd(ctx context.Context, env []string, stdout io.Writer, onStart func(pid int), name string, args ...string) (string, error) {
+	command := commandLine(name, args)
+	logrus.Debugf("command: '%s'", redactSecrets(command))
+	//not using exec.CommandContext because it only kills the main process with SIGKILL.
+	//The command runs in its own process group so that processes it spawns (ex.: ssh, rclone) are stopped too
+	acmd := exec.Command(name, args...)
+	acmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	acmd.Env = append(childEnv(), env...)
+	outBuf := &bytes.Buffer{}
+	errBuf := &tailBuffer{max: maxStderrBytes}
+	acmd.Stdout = outBuf
+	if stdout != nil {
+		acmd.Stdout = stdout
+	}
+	acmd.Stderr = errBuf
+
+	err := acmd.Start()
+	if err != nil {
+		return "", fmt.Errorf("Failed to run command: '%s'; err=%s", redactSecrets(command), err)
+	}
+	if onStart != nil {
+		onStart(acmd.Process.Pid)
+	}
 
-	out := GetCmdOutput(acmd)
-	status := acmd.Status()
-	logrus.Debugf("shell output (%d): %s", status.Exit, out)
-	if status.Exit != 0 {
-		return out, fmt.Errorf("Failed to run command: '%s'; exit=%d; out=%s", command1, status.Exit, out)
+	startTime := time.Now()
+	deadline, ok := ctx.Deadline()
+	if ok {
+		logrus.Debugf("Enforcing timeout %s", time.Until(deadline).Round(time.Second))
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			logrus.Warnf("Stopping command execution. err=%s", ctx.Err())
+			stopProcessGroup(acmd.Process.Pid, done)
+		case <-done:
+		}
+	}()
+	err = acmd.Wait()
+	close(done)
+	out := joinOutput(outBuf.String(), errBuf.String())
+	if ctx.Err() == context.DeadlineExceeded {
+		return out, &CmdTimeoutError{Command: redactSecrets(command), Timeout: time.Since(startTime).Round(time.Second), Output: out}
+	}
+	if ctx.Err() == context.Canceled {
+		return out, fmt.Errorf("Command canceled: '%s'; out=%s", redactSecrets(command), out)
+	}
+	exit := 0
+	if err != nil {
+		exit = -1
+		exitErr, ok := err.(*exec.ExitError)
+		if ok {
+			exit = exitErr.ExitCode()
+		}
+	}
+	logrus.Debugf("command output (%d): %s", exit, out)
+	if exit != 0 {
+		return out, &CmdError{Command: redactSecrets(command), ExitCode: exit, Output: out}
 	}
 	return out, nil
 }
 
-//GetCmdOutput return content of executed command
-func GetCmdOutput(cmd *cmd.Cmd) string {
-	status := cmd.Status()
-	out := strings.Join(status.Stdout, "\n")
-	if len(status.Stderr) > 0 {
-		if len(out) > 0 {
-			out = out + "\n" + strings.Join(status.Stderr, "\n")
-		} else {
-			out = strings.Join(status.Stderr, "\n")
+//stopProcessGroup send SIGTERM to a process group and SIGKILL if it is still running after killGracePeriod
+func stopProcessGroup(pid int, done chan struct{}) {
+	syscall.Kill(-pid, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(killGracePeriod):
+		logrus.Warnf("Command didn't stop after %s. Killing it", killGracePeriod)
+		syscall.Kill(-pid, syscall.SIGKILL)
+	}
+}
+
+//listFlag flag that may be repeated or have comma separated values
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if strings.TrimSpace(v) != "" {
+			*f = append(*f, strings.TrimSpace(v))
+		}
+	}
+	return nil
+}
+
+//maxStderrBytes stderr kept from a command. Older output is dropped so commands that print a lot (ex.: one error per unreadable file) don't grow memory
+var maxStderrBytes = 256 * 1024
+
+//tailBuffer keep the last max bytes written to it
+type tailBuffer struct {
+	max       int
+	buf       []byte
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = append([]byte{}, b.buf[len(b.buf)-b.max:]...)
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	if b.truncated {
+		return "[...]" + string(b.buf)
+	}
+	return string(b.buf)
+}
+
+//LineWriter call OnLine for each line written to it, without keeping the output
+type LineWriter struct {
+	OnLine  func(line string)
+	partial []byte
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	data := append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
 		}
+		w.OnLine(strings.TrimRight(string(data[:i]), "\r"))
+		data = data[i+1:]
 	}
-	return out
+	w.partial = append([]byte{}, data...)
+	return len(p), nil
+}
+
+//Flush call OnLine with the last line when it didn't end with a new line
+func (w *LineWriter) Flush() {
+	if len(w.partial) > 0 {
+		w.OnLine(string(w.partial))
+		w.partial = nil
+	}
+}
+
+//joinOutput join stdout and stderr of a command, without trailing new lines
+func joinOutput(stdout string, stderr string) string {
+	stdout = strings.TrimRight(stdout, "\n")
+	stderr = strings.TrimRight(stderr, "\n")
+	if len(stderr) == 0 {
+		return stdout
+	}
+	if len(stdout) == 0 {
+		return stderr
+	}
+	return stdout + "\n" + stderr
+}
+
+//commandLine format a command and its arguments for logs, quoting arguments with spaces or quotes
+func commandLine(name string, args []string) string {
+	line := name
+	for _, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\n'\"\\") {
+			a = strconv.Quote(a)
+		}
+		line = line + " " + a
+	}
+	return line
+}
+
+//dirStats return the number of regular files and their total size in bytes under a path
+func dirStats(path string) (files int, bytes int64, err error) {
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = files + 1
+			bytes = bytes + info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, -1, fmt.Errorf("Couldn't inspect files at %s. err=%s", path, err)
+	}
+	return files, bytes, nil
+}
+
+//parseSizeMB convert a human readable size as printed by restic (ex.: '1.427 KiB') to MB
+func parseSizeMB(size string) (float64, error) {
+	parts := strings.Fields(size)
+	if len(parts) != 2 {
+		return -1, fmt.Errorf("Invalid size '%s'", size)
+	}
+	value, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return -1, fmt.Errorf("Invalid size '%s'. err=%s", size, err)
+	}
+	switch parts[1] {
+	case "B":
+		return value / 1024 / 1024, nil
+	case "KiB":
+		return value / 1024, nil
+	case "MiB":
+		return value, nil
+	case "GiB":
+		return value * 1024, nil
+	case "TiB":
+		return value * 1024 * 1024, nil
+	}
+	return -1, fmt.Errorf("Invalid size unit '%s'", size)
+}
+
+//lastLines return the last n non empty lines of a command output
+func lastLines(out string, n int) []string {
+	lines := make([]string, 0)
+	for _, l := range strings.Split(out, "\n") {
+		if strings.TrimSpace(l) != "" {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+//countLines return the number of non empty lines in a command output
+func countLines(out string) int {
+	count := 0
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) != "" {
+			count = count + 1
+		}
+	}
+	return count
+}
+
+//firstNonEmpty return the first value that is not empty, used to resolve configuration precedence
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+//readFileEnv return the trimmed contents of the file pointed by an environment variable, or empty if not set
+func readFileEnv(name string) string {
+	file := os.Getenv(name)
+	if file == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		logrus.Warnf("Couldn't read %s file %s. err=%s", name, file, err)
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+var urlCredentialsRex = regexp.MustCompile("://([^:/@\\s]+):[^@\\s]+@")
+
+//redactSecrets hide credentials embedded in repository URLs before logging commands
+func redactSecrets(command string) string {
+	return urlCredentialsRex.ReplaceAllString(command, "://$1:***@")
+}
+
+//watchDir call onChange whenever a file in dir is created, written, removed or renamed.
+//The dir is watched instead of the files because Kubernetes updates mounted secrets by swapping a symlinked dir
+func watchDir(dir string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	err = watcher.Add(dir)
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&fsnotify.Chmod == fsnotify.Chmod {
+					continue
+				}
+				logrus.Debugf("Detected change on %s", event.Name)
+				onChange()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logrus.Warnf("Error watching %s. err=%s", dir, err)
+			}
+		}
+	}()
+	return nil
 }
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// VaultClient read repository passwords and backend credentials from HashiCorp Vault
+type VaultClient struct {
+	addr      string
+	auth      string
+	authPath  string
+	roleID    string
+	secretID  string
+	k8sRole   string
+	k8sToken  string
+	client    *http.Client
+	lock      *sync.Mutex
+	token     string
+	renewable bool
+	expiry    time.Time
+	renewAt   time.Time
+	secrets   map[string]*vaultSecret
+}
+
+// vaultSecret secret values read from a Vault path and its lease
+type vaultSecret struct {
+	values    map[string]string
+	leaseID   string
+	renewable bool
+	expiry    time.Time
+	renewAt   time.Time
+}
+
+// vaultClient client used by repositories with a 'vaultPath'. nil if Vault is not configured
+var vaultClient *VaultClient
+
+// vaultSecretsTTL seconds secrets without a lease (ex.: kv) are cached before being read again
+var vaultSecretsTTL = 300
+
+// NewVaultClient create a Vault client authenticated with a token, AppRole (roleID/secretID) or Kubernetes service account (k8sRole)
+func NewVaultClient(addr string, token string, roleID string, secretID string, k8sRole string, k8sTokenFile string, authPath string, caCertFile string) (*VaultClient, error) {
+	v := &VaultClient{
+		addr:     strings.TrimSuffix(addr, "/"),
+		authPath: authPath,
+		roleID:   roleID,
+		secretID: secretID,
+		k8sRole:  k8sRole,
+		k8sToken: k8sTokenFile,
+		lock:     &sync.Mutex{},
+		secrets:  map[string]*vaultSecret{},
+	}
+
+	transport := &http.Transport{}
+	if caCertFile != "" {
+		pem, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read Vault CA certificate %s. err=%s", caCertFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in Vault CA certificate %s", caCertFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	v.client = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+
+	if token != "" {
+		v.auth = "token"
+		v.token = token
+	} else if roleID != "" {
+		v.auth = "approle"
+	} else if k8sRole != "" {
+		v.auth = "kubernetes"
+	} else {
+		return nil, fmt.Errorf("A Vault token, AppRole role id or Kubernetes role is required")
+	}
+	if v.authPath == "" {
+		v.authPath = v.auth
+	}
+
+	err := v.login()
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Using Vault %s with %s auth", v.addr, v.auth)
+	return v, nil
+}
+
+// login obtain a client token, or lookup the configured token's ttl
+func (v *VaultClient) login() error {
+	var resp map[string]interface{}
+	var err error
+	switch v.auth {
+	case "token":
+		resp, err = v.request("GET", "auth/token/lookup-self", nil)
+		if err != nil {
+			return fmt.Errorf("Couldn't lookup Vault token. err=%s", err)
+		}
+		data, _ := resp["data"].(map[string]interface{})
+		ttl, _ := data["ttl"].(float64)
+		renewable, _ := data["renewable"].(bool)
+		v.setTokenLease(v.token, ttl, renewable)
+		return nil
+	case "approle":
+		resp, err = v.request("POST", fmt.Sprintf("auth/%s/login", v.authPath), map[string]string{"role_id": v.roleID, "secret_id": v.secretID})
+	case "kubernetes":
+		//projected service account tokens are rotated, so read it on each login
+		jwt, err1 := ioutil.ReadFile(v.k8sToken)
+		if err1 != nil {
+			return fmt.Errorf("Couldn't read Kubernetes service account token %s. err=%s", v.k8sToken, err1)
+		}
+		resp, err = v.request("POST", fmt.Sprintf("auth/%s/login", v.authPath), map[string]string{"role": v.k8sRole, "jwt": strings.TrimSpace(string(jwt))})
+	}
+	if err != nil {
+		return fmt.Errorf("Couldn't login to Vault with %s auth. err=%s", v.auth, err)
+	}
+	auth, ok := resp["auth"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Vault %s login returned no token", v.auth)
+	}
+	token, _ := auth["client_token"].(string)
+	ttl, _ := auth["lease_duration"].(float64)
+	renewable, _ := auth["renewable"].(bool)
+	v.setTokenLease(token, ttl, renewable)
+	logrus.Debugf("Logged in to Vault with %s auth. ttl=%.0fs", v.auth, ttl)
+	return nil
+}
+
+// setTokenLease use token until its ttl expires
+func (v *VaultClient) setTokenLease(token string, ttlSeconds float64, renewable bool) {
+	v.token = token
+	v.renewable = renewable
+	v.expiry, v.renewAt = leaseTimes(ttlSeconds)
+}
+
+// renewToken renew the client token when less than a third of its ttl is left, logging in again if it can't be renewed
+func (v *VaultClient) renewToken() error {
+	if v.expiry.IsZero() || time.Now().Before(v.renewAt) {
+		return nil
+	}
+	if v.renewable {
+		resp, err := v.request("POST", "auth/token/renew-self", map[string]string{})
+		if err == nil {
+			auth, _ := resp["auth"].(map[string]interface{})
+			ttl, _ := auth["lease_duration"].(float64)
+			renewable, _ := auth["renewable"].(bool)
+			v.setTokenLease(v.token, ttl, renewable)
+			logrus.Debugf("Vault token renewed. ttl=%.0fs", ttl)
+			return nil
+		}
+		logrus.Warnf("Couldn't renew Vault token. err=%s", err)
+	}
+	if v.auth == "token" {
+		if time.Now().After(v.expiry) {
+			return fmt.Errorf("Vault token expired")
+		}
+		return nil
+	}
+	return v.login()
+}
+
+// read return the string values of the secret at path (ex.: 'secret/data/backups' for kv v2), renewing its lease or reading it again when it is about to expire
+func (v *VaultClient) read(path string) (map[string]string, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	err := v.renewToken()
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := v.secrets[path]
+	if ok && time.Now().Before(s.renewAt) {
+		return s.values, nil
+	}
+	if ok && s.renewable && time.Now().Before(s.expiry) {
+		resp, err := v.request("PUT", "sys/leases/renew", map[string]string{"lease_id": s.leaseID})
+		if err == nil {
+			ttl, _ := resp["lease_duration"].(float64)
+			if ttl > 0 {
+				s.expiry, s.renewAt = leaseTimes(ttl)
+				logrus.Debugf("Vault lease of %s renewed. ttl=%.0fs", path, ttl)
+				return s.values, nil
+			}
+		}
+		logrus.Warnf("Couldn't renew Vault lease of %s. Reading it again. err=%s", path, err)
+	}
+
+	resp, err := v.request("GET", path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read Vault secret %s. err=%s", path, err)
+	}
+	data, ok := resp["data"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Vault secret %s has no data", path)
+	}
+	//kv v2 nests the values in data.data
+	_, hasMetadata := data["metadata"]
+	nested, isNested := data["data"].(map[string]interface{})
+	if hasMetadata && isNested {
+		data = nested
+	}
+
+	s = &vaultSecret{values: map[string]string{}}
+	for k, val := range data {
+		s.values[k] = fmt.Sprintf("%v", val)
+	}
+	s.leaseID, _ = resp["lease_id"].(string)
+	s.renewable, _ = resp["renewable"].(bool)
+	ttl, _ := resp["lease_duration"].(float64)
+	if ttl <= 0 || s.leaseID == "" {
+		ttl = float64(vaultSecretsTTL)
+	}
+	s.expiry, s.renewAt = leaseTimes(ttl)
+	v.secrets[path] = s
+	logrus.Debugf("Read Vault secret %s. ttl=%.0fs", path, ttl)
+	return s.values, nil
+}
+
+// leaseTimes return when a lease with ttl expires and when it should be renewed (after two thirds of its ttl). Zero times if it doesn't expire
+func leaseTimes(ttlSeconds float64) (time.Time, time.Time) {
+	if ttlSeconds <= 0 {
+		return time.Time{}, time.Time{}
+	}
+	ttl := time.Duration(ttlSeconds) * time.Second
+	now := time.Now()
+	return now.Add(ttl), now.Add(ttl * 2 / 3)
+}
+
+// request call the Vault HTTP API and return the decoded JSON response
+func (v *VaultClient) request(method string, path string, body interface{}) (map[string]interface{}, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader([]byte{})
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s", v.addr, strings.TrimPrefix(path, "/")), reader)
+	if err != nil {
+		return nil, err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("status=%d response=%s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	result := map[string]interface{}{}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &result)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Vault response. err=%s", err)
+		}
+	}
+	return result, nil
+}